@@ -1,9 +1,3 @@
-# make log and ddht persistance directory structures
-cd persistance
-mkdir log
-mkdir dht
-cd ..
-
 #install libraries
 go get -d -v ./...
 go get -u github.com/golang/protobuf/protoc-gen-go
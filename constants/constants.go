@@ -5,7 +5,42 @@ import "time"
 const (
 	NUM_BYTES            = 32
 	K_BUCKET_SIZE        = 20
+	ALPHA                = 3
 	HASH_SIZE            = NUM_BYTES * 8
 	TIME_DURATION        = 5 * time.Second
 	LOG_OBJECT_BYTE_SIZE = 10
+	REFRESH_INTERVAL     = 1 * time.Hour
+	SEEN_QUEUE_SIZE      = 64
+	SYNC_INTERVAL        = 1 * time.Minute
+
+	// log records are a version byte, the size of the log object and its CRC32C checksum
+	LOG_RECORD_VERSION     = 1
+	LOG_CHECKSUM_BYTE_SIZE = 4
+	LOG_HEADER_BYTE_SIZE   = 1 + LOG_OBJECT_BYTE_SIZE + LOG_CHECKSUM_BYTE_SIZE
+	MAX_LOG_OBJECT_SIZE    = 1 << 20
+
+	// encrypted log records and dht files are frames carrying the id of their key
+	LOG_ENCRYPTED_RECORD_VERSION   = 2
+	LOG_KEY_ID_BYTE_SIZE           = 4
+	LOG_ENCRYPTED_HEADER_BYTE_SIZE = 1 + LOG_KEY_ID_BYTE_SIZE + LOG_OBJECT_BYTE_SIZE + LOG_CHECKSUM_BYTE_SIZE
+
+	SNAPSHOT_FORMAT_VERSION = 1
+
+	// log appends are batched into one write and fsync for upto the commit latency
+	LOG_COMMIT_LATENCY = 2 * time.Millisecond
+	LOG_MAX_BATCH_SIZE = 256
+
+	// the log is compacted into a snapshot once it holds this many records or bytes
+	COMPACT_LOG_RECORDS = 10000
+	COMPACT_LOG_BYTES   = 4 << 20
+
+	// opening a bolt database locked by another process is given up on after this long
+	BOLT_OPEN_TIMEOUT = 1 * time.Second
+
+	// a node keeps upto this many values of Store requests, of upto MAX_VALUE_SIZE bytes
+	// each and MAX_STORED_BYTES in total, for at most MAX_VALUE_TTL
+	MAX_STORED_VALUES = 10000
+	MAX_VALUE_SIZE    = 64 << 10
+	MAX_STORED_BYTES  = 64 << 20
+	MAX_VALUE_TTL     = 24 * time.Hour
 )
@@ -0,0 +1,123 @@
+package dht
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hydra-dht/constants"
+	pb "hydra-dht/protobuf/node"
+	structures "hydra-dht/structures"
+	"log"
+	"net"
+	"strconv"
+)
+
+// ErrNoSeeds is returned by Join when none of the seed nodes could be reached
+var ErrNoSeeds = errors.New("none of the seed nodes responded")
+
+// insertNode adds the node into the DHT and waits for the row listener's response
+func (rt *RoutingTable) insertNode(n structures.Node) structures.AddNodeResponse {
+	select {
+	case response := <-rt.addNode(n):
+		return response
+	case <-rt.quit:
+		return structures.AddNodeResponse{ListIndex: -1}
+	}
+}
+
+// insertNodes adds every node into the DHT, skipping the current node
+func (rt *RoutingTable) insertNodes(nodes []structures.Node) {
+	for _, n := range nodes {
+		if n.Key != rt.self.Key {
+			rt.insertNode(n)
+		}
+	}
+}
+
+// pingSeed pings a seed node at address host:port and returns the node it identifies itself as
+func (rt *RoutingTable) pingSeed(address string) (structures.Node, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return structures.Node{}, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return structures.Node{}, err
+	}
+
+	livliness, err := rt.Ping(structures.Node{Domain: host, Port: port})
+	if err != nil {
+		return structures.Node{}, err
+	}
+	if !livliness.Alive || livliness.Node == nil {
+		return structures.Node{}, fmt.Errorf("seed node %s did not respond as alive", address)
+	}
+
+	seed := toNodes([]*pb.Node{livliness.Node})[0]
+	// the seed may only know itself by a local address, reach it the way we just did
+	seed.Domain = host
+	seed.Port = port
+	return seed, nil
+}
+
+// randomIDInRow generates a random key that falls in the given row of the DHT,
+// i.e it shares the first row bits with the current node and differs in the next one
+func (rt *RoutingTable) randomIDInRow(row int) structures.NodeID {
+	var id structures.NodeID
+	rand.Read(id[:])
+
+	myKey := rt.self.Key
+	byteIndex := row / 8
+	bitIndex := uint(row % 8)
+	prefixMask := uint8(0xff) << (8 - bitIndex)
+	flipBit := uint8(0x80) >> bitIndex
+
+	copy(id[:byteIndex], myKey[:byteIndex])
+	id[byteIndex] = (myKey[byteIndex] & prefixMask) | (^myKey[byteIndex] & flipBit) | (id[byteIndex] &^ (prefixMask | flipBit))
+	return id
+}
+
+/*
+Join joins the network through the seed nodes.
+
+It pings every seed and inserts the ones that respond into the DHT. Then it
+performs a lookup for its own key, which fills the rows close to it, and finally
+refreshes every row farther away than its closest neighbour by looking up a
+random key in that row.
+
+Arguments:
+1. seeds: Addresses of the seed nodes in host:port format
+Returns:
+1. error: ErrNoSeeds if no seed could be reached, nil otherwise
+*/
+func (rt *RoutingTable) Join(seeds []string) error {
+	joined := 0
+	for _, address := range seeds {
+		seed, err := rt.pingSeed(address)
+		if err != nil {
+			log.Printf("failed to reach seed node %s: %v", address, err)
+			continue
+		}
+		if seed.Key == rt.self.Key {
+			continue
+		}
+		rt.insertNode(seed)
+		joined++
+	}
+	if joined == 0 {
+		return ErrNoSeeds
+	}
+
+	neighbours := rt.Lookup(rt.self.Key)
+	rt.insertNodes(neighbours)
+	if len(neighbours) == 0 {
+		return nil
+	}
+
+	// rows with a smaller index are farther away from the current node
+	closestRow := rt.GetRowNum(&neighbours[0])
+	for row := 0; row < closestRow && row < constants.HASH_SIZE; row++ {
+		rt.insertNodes(rt.Lookup(rt.randomIDInRow(row)))
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package dht
+
+import (
+	"bytes"
+	structures "hydra-dht/structures"
+	"testing"
+)
+
+func TestRandomIDInRow(t *testing.T) {
+	var keys = []structures.NodeID{
+		{},
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0xa5, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124,
+			234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 0x5a},
+	}
+	var rows = []int{0, 1, 7, 8, 9, 15, 16, 127, 128, 247, 248, 254, 255}
+
+	for _, key := range keys {
+		rt := &RoutingTable{self: structures.Node{Key: key}}
+		for _, row := range rows {
+			// the key is random, try a few
+			for i := 0; i < 20; i++ {
+				id := rt.randomIDInRow(row)
+				if got := rt.GetRowNum(&structures.Node{Key: id}); got != row {
+					t.Errorf("GetRowNum(randomIDInRow(%d)) of node %x => %d", row, key[:4], got)
+					break
+				}
+				if !bytes.Equal(id[:row/8], key[:row/8]) {
+					t.Errorf("randomIDInRow(%d) of node %x => %x;want the leading bytes of the node", row, key[:4], id)
+					break
+				}
+			}
+		}
+	}
+}
@@ -1,60 +1,369 @@
 package dht
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"hydra-dht/constants"
-	nodedetails "hydra-dht/nodedetails"
 	"hydra-dht/persistance"
 	pb "hydra-dht/protobuf/node"
 	structures "hydra-dht/structures"
 	"log"
 	"math/bits"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
 )
 
-var (
+// Options configures a RoutingTable
+type Options struct {
+	// BucketSize is the max number of nodes that can be saved in a list
+	BucketSize int
+	// CacheExpiryMinutes is the time after which a node is pinged again before eviction
+	CacheExpiryMinutes float64
+	// Domain and Port are what other nodes reach the current node at
+	Domain string
+	Port   int
+	// RefreshInterval is the time after which a row with no lookups is refreshed,
+	// REFRESH_INTERVAL if not set
+	RefreshInterval time.Duration
+	// DataDir is the directory the routing table is persisted in. If set, the routing
+	// table is restored from it, its mutations are appended to the persistance log
+	// and it is periodically synced to disk. Persistance is switched off if empty.
+	DataDir string
+	// Backend is the storage the routing table is persisted in instead of files in
+	// DataDir. It is owned by the caller and must be closed after the routing table.
+	Backend persistance.Backend
+	// SyncInterval is the time between syncs of the routing table to disk,
+	// SYNC_INTERVAL if not set
+	SyncInterval time.Duration
+	// CommitLatency is the max time an append to the persistance log waits for others
+	// to share its write and fsync, LOG_COMMIT_LATENCY if not set
+	CommitLatency time.Duration
+	// CompactLogRecords and CompactLogBytes are the size of the persistance log at which
+	// the routing table is synced to disk before the sync interval is up, so recovery
+	// replays at most that much. COMPACT_LOG_RECORDS and COMPACT_LOG_BYTES if not set
+	CompactLogRecords int
+	CompactLogBytes   int64
+	// StrictRecovery makes New fail with a *persistance.RecoveryError instead of
+	// discarding persisted files it can't recover the routing table from
+	StrictRecovery bool
+}
+
+// RoutingTable is the Kademlia routing table of a node. Each of the 256 rows of the
+// DHT is owned by a listener goroutine which serializes all insertions into that row.
+type RoutingTable struct {
+	self               structures.Node
 	dht                structures.DHT
-	channels           structures.IndexChannels
 	cache              structures.Cache
-	bucketSize         = 0
-	cacheExpiryMinutes = 1.0
-)
+	replacements       structures.Replacements
+	channels           structures.IndexChannels
+	lock               sync.RWMutex
+	bucketSize         int
+	cacheExpiryMinutes float64
+	refreshInterval    time.Duration
+	store              *persistance.Store
+	syncLock           sync.Mutex
+	lastLookup         [constants.HASH_SIZE]time.Time
+	now                func() time.Time // clock of lastLookup, faked in tests
+	quit               chan struct{}
+	workers            sync.WaitGroup
+}
+
+/*
+New creates a routing table for the node with key self and starts the row listeners.
+If persistance is switched on, the DHT is first recovered from disk.
+The table must be shut down with Close.
+
+Arguments:
+1. self: Key of the current node
+2. opts: Options of the routing table
+Returns:
+1. *RoutingTable: The routing table
+2. error: Error in recovering the DHT, nil if no error
+*/
+func New(self structures.NodeID, opts Options) (*RoutingTable, error) {
+	rt := &RoutingTable{
+		self:               structures.Node{Key: self, Domain: opts.Domain, Port: opts.Port},
+		bucketSize:         opts.BucketSize,
+		cacheExpiryMinutes: opts.CacheExpiryMinutes,
+		refreshInterval:    opts.RefreshInterval,
+		now:                time.Now,
+		quit:               make(chan struct{}),
+	}
+	if rt.refreshInterval <= 0 {
+		rt.refreshInterval = constants.REFRESH_INTERVAL
+	}
+
+	now := rt.now()
+	for i := 0; i < constants.HASH_SIZE; i++ {
+		rt.lastLookup[i] = now
+	}
+
+	if opts.Backend != nil || opts.DataDir != "" {
+		backend := opts.Backend
+		if backend == nil {
+			var err error
+			backend, err = persistance.NewFileBackend(opts.DataDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		store := persistance.NewStoreWithBackend(backend)
+		store.SetSnapshotHeader(self, rt.bucketSize)
+		if opts.CommitLatency > 0 {
+			store.SetCommitLatency(opts.CommitLatency)
+		}
+		compactRecords, compactBytes := opts.CompactLogRecords, opts.CompactLogBytes
+		if compactRecords <= 0 {
+			compactRecords = constants.COMPACT_LOG_RECORDS
+		}
+		if compactBytes <= 0 {
+			compactBytes = constants.COMPACT_LOG_BYTES
+		}
+		store.SetCompactionPolicy(compactRecords, compactBytes)
+		store.SetStrictRecovery(opts.StrictRecovery)
+		dht, cache, _, _, err := store.InitPersistance()
+		if err != nil {
+			return nil, err
+		}
+		logRecovery(store.LastRecovery())
+		rt.store = store
+		rt.restore(dht, cache)
+	}
+
+	// Setting up DHT listeners
+	for i := 0; i < constants.HASH_SIZE; i++ {
+		rt.channels.WriteChannel[i] = make(chan *structures.NodePacket)
+		rt.channels.SeenChannel[i] = make(chan structures.Node, constants.SEEN_QUEUE_SIZE)
+		rt.workers.Add(1)
+		go rt.Listeners(i)
+	}
+
+	rt.workers.Add(1)
+	go rt.refreshBuckets()
+
+	if rt.store != nil {
+		syncInterval := opts.SyncInterval
+		if syncInterval <= 0 {
+			syncInterval = constants.SYNC_INTERVAL
+		}
+		rt.workers.Add(1)
+		go func() {
+			defer rt.workers.Done()
+			rt.periodicSyncDHT(syncInterval)
+		}()
+	}
 
-func PeriodicSyncDHT(c chan int, duration time.Duration) {
+	return rt, nil
+}
+
+/*
+restore loads the recovered DHT and its cache into the routing table, so the liveness
+known of the nodes survives a restart. Nodes beyond the bucket size are kept as
+replacement candidates.
+*/
+func (rt *RoutingTable) restore(dht *structures.DHT, cache *structures.Cache) {
+	for row := 0; row < constants.HASH_SIZE; row++ {
+		nodes := dht.Lists[row]
+		caches := cache.Lists[row]
+		if len(nodes) > rt.bucketSize {
+			rt.replacements.Lists[row] = append(rt.replacements.Lists[row], nodes[rt.bucketSize:]...)
+			nodes = nodes[:rt.bucketSize]
+			caches = caches[:rt.bucketSize]
+		}
+		rt.dht.Lists[row] = nodes
+		rt.cache.Lists[row] = caches
+	}
+}
+
+// logRecovery logs what the routing table was recovered from and the files left out
+func logRecovery(report persistance.RecoveryReport) {
+	snapshot := report.Snapshot
+	if snapshot == "" {
+		snapshot = "an empty table"
+	}
+	log.Printf("recovered routing table from %s, replayed %d records of %d logs", snapshot, report.RecordsApplied, len(report.LogsReplayed))
+	if report.TruncatedBytes > 0 {
+		log.Printf("truncated %d bytes of invalid records at the end of the logs", report.TruncatedBytes)
+	}
+	for _, f := range report.Skipped {
+		log.Printf("skipped unreadable %s: %v", f.Name, f.Reason)
+	}
+	for _, f := range report.Discarded {
+		log.Printf("discarded %s: %v", f.Name, f.Reason)
+	}
+}
+
+// RecoveryReport returns the report of the recovery of the routing table, false if
+// persistance is switched off
+func (rt *RoutingTable) RecoveryReport() (persistance.RecoveryReport, bool) {
+	if rt.store == nil {
+		return persistance.RecoveryReport{}, false
+	}
+	return rt.store.LastRecovery(), true
+}
+
+// Close stops the row listeners, bucket refresher and periodic sync of the routing table
+func (rt *RoutingTable) Close() {
+	close(rt.quit)
+	rt.workers.Wait()
+
+	if rt.store != nil {
+		if err := rt.store.ClosePersistance(); err != nil {
+			log.Printf("failed to close persistance log: %v", err)
+		}
+	}
+}
+
+// periodicSyncDHT persists the DHT every duration till the routing table is closed,
+// or sooner once the persistance log grows past the compaction limits. Syncs are
+// skipped if nothing was logged since the last one. New starts the only one of a
+// routing table, read Options.SyncInterval.
+func (rt *RoutingTable) periodicSyncDHT(duration time.Duration) {
 	// clear log
 	for {
 		select {
 		case <-time.After(duration):
-			// send dht at that extent
-			persistance.PersistDHT(dht)
-			// for the unit test
-			c <- 1
+			rt.syncDHT(false)
+		case <-rt.store.CompactionDue():
+			rt.syncDHT(true)
+		case <-rt.quit:
+			return
 		}
 	}
 }
 
-func getDHT() *structures.DHT {
-	return &dht
+// syncDHT persists the DHT if anything was logged since the last sync. If compact is
+// set it is only persisted if the log is still past the compaction limits.
+func (rt *RoutingTable) syncDHT(compact bool) {
+	// the store switches to a new log, so syncs mustn't overlap
+	rt.syncLock.Lock()
+	defer rt.syncLock.Unlock()
+	// send dht at that extent, no mutation can happen while it is written
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	if rt.store.Stats().LogRecords == 0 || (compact && !rt.store.NeedsCompaction()) {
+		return
+	}
+	if err := rt.store.PersistDHT(rt.dht, rt.cache); err != nil {
+		log.Printf("failed to sync DHT to disk: %v", err)
+	}
+}
+
+// PersistanceStats returns the statistics of the persistance log and snapshots,
+// false if persistance is switched off
+func (rt *RoutingTable) PersistanceStats() (persistance.Stats, bool) {
+	if rt.store == nil {
+		return persistance.Stats{}, false
+	}
+	return rt.store.Stats(), true
 }
 
 // Appends to list of nodes of DHT's row
-func addInDHT(n *structures.Node, row int) {
+func (rt *RoutingTable) addInDHT(n *structures.Node, row int) {
 	fmt.Println("Added node into DHT")
 	fmt.Println(n)
 
-	updateDHT(row, -1, n)
-	updateCache(row, -1, false)
+	rt.lock.Lock()
+	rt.dht.Lists[row] = append(rt.dht.Lists[row], *n)
+	rt.cache.Lists[row] = append(rt.cache.Lists[row], structures.CacheObject{LastTime: time.Now(), Dead: false})
+	logged := rt.logMutation(row, len(rt.dht.Lists[row])-1, false)
+	rt.lock.Unlock()
+
+	waitLogged(logged)
 }
 
-// Replace in list of nodes of DHT's row
-func replaceInDHT(n *structures.Node, row int, replaced int) {
+/*
+logMutation queues a mutation of the node at col of the row to be appended to the
+persistance log, along with its cache entry. Removals are logged before the node is
+removed, all else after the mutation. It is called with the lock held, so that a
+periodic sync never snapshots a mutation that is also in the new log, or misses one
+that went to the old log. The returned channel is waited on with waitLogged once the
+lock is released, so that mutations of other rows share the fsync meanwhile.
+It returns nil if persistance is switched off.
+*/
+func (rt *RoutingTable) logMutation(row int, col int, removed bool) <-chan error {
+	if rt.store == nil {
+		return nil
+	}
+
+	n := rt.dht.Lists[row][col]
+	if removed {
+		return rt.store.AppendRemovalToLogAsync(n, int32(row), int32(col))
+	}
+	return rt.store.AppendToLogAsync(n, rt.cache.Lists[row][col], int32(row), int32(col))
+}
+
+// logTouch queues the single record of the node at the tail of the row having moved
+// there from col, read documentation of logMutation
+func (rt *RoutingTable) logTouch(row int, col int) <-chan error {
+	if rt.store == nil {
+		return nil
+	}
+
+	tail := len(rt.dht.Lists[row]) - 1
+	return rt.store.AppendTouchToLogAsync(rt.dht.Lists[row][tail], rt.cache.Lists[row][tail], int32(row), int32(col))
+}
+
+// waitLogged waits for the mutations queued by logMutation to reach the disk
+func waitLogged(logged ...<-chan error) {
+	for _, c := range logged {
+		if c == nil {
+			continue
+		}
+		if err := <-c; err != nil {
+			log.Printf("failed to append to persistance log: %v", err)
+		}
+	}
+}
+
+// Replace in list of nodes of DHT's row. The replaced node is evicted and the
+// new node goes to the tail as the most recently seen.
+func (rt *RoutingTable) replaceInDHT(n *structures.Node, row int, replaced int) {
 
-	updateDHT(row, replaced, n)
-	updateCache(row, replaced, false)
+	rt.removeFromRow(row, replaced)
+	rt.addInDHT(n, row)
+}
+
+// removeFromDHT evicts the node at col from the row and promotes the freshest replacement candidate into the freed slot
+func (rt *RoutingTable) removeFromDHT(row int, col int) {
+	rt.removeFromRow(row, col)
+
+	if candidate, ok := rt.popReplacement(row); ok {
+		rt.addInDHT(&candidate, row)
+	}
+}
+
+// removeFromRow removes the node at col from the row of both the DHT and cache
+func (rt *RoutingTable) removeFromRow(row int, col int) {
+	rt.lock.Lock()
+	logged := rt.logMutation(row, col, true)
+
+	rt.dht.Lists[row] = append(rt.dht.Lists[row][:col:col], rt.dht.Lists[row][col+1:]...)
+	rt.cache.Lists[row] = append(rt.cache.Lists[row][:col:col], rt.cache.Lists[row][col+1:]...)
+	rt.lock.Unlock()
+
+	waitLogged(logged)
+}
+
+// moveToTail moves the node at col to the tail of its row as the most recently
+// seen node, refreshing its cache entry
+func (rt *RoutingTable) moveToTail(row int, col int) {
+	rt.lock.Lock()
+	n := rt.dht.Lists[row][col]
+	rt.dht.Lists[row] = append(append(rt.dht.Lists[row][:col:col], rt.dht.Lists[row][col+1:]...), n)
+	rt.cache.Lists[row] = append(append(rt.cache.Lists[row][:col:col], rt.cache.Lists[row][col+1:]...),
+		structures.CacheObject{LastTime: time.Now(), Dead: false})
+
+	touched := rt.logTouch(row, col)
+	rt.lock.Unlock()
+
+	waitLogged(touched)
 }
 
 // get node Client sets up connection
@@ -74,63 +383,134 @@ func getNodeClient(serverAddress *string) (pb.NodeDiscoveryClient, *grpc.ClientC
 }
 
 //Ping makes a GRPC call to node and gets response
-func Ping(n structures.Node) (*pb.PingResponse, error) {
+func (rt *RoutingTable) Ping(n structures.Node) (*pb.PingResponse, error) {
+	livliness, err := rt.ping(n)
+	if err == nil && livliness.Alive {
+		rt.markSeen(n)
+	}
+	return livliness, err
+}
+
+// ping makes the GRPC call of Ping, leaving the row of the node to the caller
+func (rt *RoutingTable) ping(n structures.Node) (*pb.PingResponse, error) {
 	hostname := n.Domain + ":" + strconv.Itoa(int(n.Port))
 	client, conn := getNodeClient(&hostname)
 	defer conn.Close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), constants.TIME_DURATION)
 	defer cancel()
-	livliness, err := client.Ping(ctx, &pb.Node{
-		NodeId: nodedetails.MyNode.Key[:],
-		Domain: n.Domain,
-		Port:   int32(n.Port),
-	})
+	return client.Ping(ctx, rt.myPbNode())
+}
 
-	return livliness, err
+// FindNodes makes a GRPC call to node asking for the nodes it knows closest to target
+func (rt *RoutingTable) FindNodes(n structures.Node, target structures.NodeID) ([]structures.Node, error) {
+	hostname := n.Domain + ":" + strconv.Itoa(int(n.Port))
+	client, conn := getNodeClient(&hostname)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), constants.TIME_DURATION)
+	defer cancel()
+	closerNodes, err := client.FindNodes(ctx, &pb.FindNodesRequest{
+		Sender: rt.myPbNode(),
+		Target: target[:],
+	})
+	if err != nil {
+		return nil, err
+	}
+	rt.markSeen(n)
+	return toNodes(closerNodes.Nodes), nil
 }
 
-// pingNode pings the node if no response till 5 seconds, return dead node
-func pingNode(n structures.Node, pings chan int, row int, col int) {
-	c := make(chan int, 1)
+// storeAt makes a GRPC call to node asking it to store the key value pair
+func (rt *RoutingTable) storeAt(n structures.Node, key structures.NodeID, value []byte, ttl time.Duration) (bool, error) {
+	hostname := n.Domain + ":" + strconv.Itoa(int(n.Port))
+	client, conn := getNodeClient(&hostname)
+	defer conn.Close()
 
-	go func() {
-		livliness, err := Ping(n)
-		dead := false
+	ctx, cancel := context.WithTimeout(context.Background(), constants.TIME_DURATION)
+	defer cancel()
+	response, err := client.Store(ctx, &pb.StoreRequest{
+		Sender: rt.myPbNode(),
+		Key:    key[:],
+		Value:  value,
+		Ttl:    int64(ttl.Seconds()),
+	})
+	if err != nil {
+		return false, err
+	}
+	rt.markSeen(n)
+	return response.Stored, nil
+}
 
-		if err != nil || !livliness.Alive {
-			dead = true
-		}
-		updateCache(row, col, dead)
-		c <- 1
-	}()
+// findValueAt makes a GRPC call to node asking for the value of key. If the node
+// doesn't have the value, it returns the nodes it knows closest to key
+func (rt *RoutingTable) findValueAt(n structures.Node, key structures.NodeID) ([]byte, bool, []structures.Node, error) {
+	hostname := n.Domain + ":" + strconv.Itoa(int(n.Port))
+	client, conn := getNodeClient(&hostname)
+	defer conn.Close()
 
-	select {
-	case <-c:
-		pings <- 1
+	ctx, cancel := context.WithTimeout(context.Background(), constants.TIME_DURATION)
+	defer cancel()
+	response, err := client.FindValue(ctx, &pb.FindValueRequest{
+		Sender: rt.myPbNode(),
+		Key:    key[:],
+	})
+	if err != nil {
+		return nil, false, nil, err
+	}
+	rt.markSeen(n)
+	return response.Value, response.Found, toNodes(response.CloserNodes), nil
+}
 
-	case <-time.After(constants.TIME_DURATION):
-		updateCache(row, col, false)
-		pings <- 1
+// myPbNode returns the current node as a protobuf node
+func (rt *RoutingTable) myPbNode() *pb.Node {
+	return &pb.Node{
+		NodeId: rt.self.Key[:],
+		Domain: rt.self.Domain,
+		Port:   int32(rt.self.Port),
 	}
 }
 
-// checks response for all nodes and returns after all nodes have responded
-func mergeAllPings(final chan int, pings chan int) {
-	i := 0
-	for {
-		i += <-pings
-		if i == bucketSize {
-			final <- 1
+// toNodes converts protobuf nodes to DHT nodes
+func toNodes(pbNodes []*pb.Node) []structures.Node {
+	var nodes []structures.Node
+	for _, p := range pbNodes {
+		var key structures.NodeID
+		copy(key[:], p.NodeId)
+		nodes = append(nodes, structures.Node{Key: key, Domain: p.Domain, Port: int(p.Port)})
+	}
+	return nodes
+}
+
+// pingNode pings the node at col of the row. A reply moves it to the tail of the row,
+// no reply within 5 seconds marks it dead.
+func (rt *RoutingTable) pingNode(n structures.Node, row int, col int) {
+	c := make(chan bool, 1)
+
+	// the listener moves the node itself, it isn't reported seen
+	go func() {
+		livliness, err := rt.ping(n)
+		c <- err != nil || !livliness.Alive
+	}()
+
+	select {
+	case dead := <-c:
+		if !dead {
+			// the node replied, it is the most recently seen of the row now
+			rt.moveToTail(row, col)
 			return
 		}
+		rt.updateCache(row, col, true)
+
+	case <-time.After(constants.TIME_DURATION):
+		rt.updateCache(row, col, true)
 	}
 }
 
 // checkForDeadNodes checks if there are any dead nodes from previous pings
-func checkForDeadNodes(row int) (bool, int) {
-	for i := 0; i < len(dht.Lists[row]); i++ {
-		if getCacheVal(row, i).Dead == true {
+func (rt *RoutingTable) checkForDeadNodes(row int) (bool, int) {
+	for i := 0; i < len(rt.dht.Lists[row]); i++ {
+		if rt.getCacheVal(row, i).Dead == true {
 			return true, i
 		}
 	}
@@ -138,9 +518,9 @@ func checkForDeadNodes(row int) (bool, int) {
 }
 
 // isNodeOld checks if node has expired in cache.
-func isNodeOld(row int, col int) bool {
+func (rt *RoutingTable) isNodeOld(row int, col int) bool {
 
-	if time.Since(getCacheVal(row, col).LastTime).Minutes() >= cacheExpiryMinutes {
+	if time.Since(rt.getCacheVal(row, col).LastTime).Minutes() >= rt.cacheExpiryMinutes {
 		return true
 	}
 	return false
@@ -148,88 +528,202 @@ func isNodeOld(row int, col int) bool {
 
 /*
    checkAndUpdateCache checks cache for dead nodes, if
-   not found update pings of all nodes. Then check for
-   dead nodes, return index if any. Else return -1
+   not found pings the least recently seen node at the head
+   of the row once it has expired. If it is dead, return its index.
+   Else -1 is returned, the head is only moved to the tail of the
+   row by a reply to the ping, read documentation of pingNode.
 */
-func checkAndUpdateCache(row int) (int, bool) {
-	ping := false
-	dead, i := checkForDeadNodes(row)
-
+func (rt *RoutingTable) checkAndUpdateCache(row int) (int, bool) {
+	dead, i := rt.checkForDeadNodes(row)
 	if dead {
-		return i, ping
+		return i, false
 	}
 
-	ping = true
-	final := make(chan int)
-	pings := make(chan int)
-
-	go mergeAllPings(final, pings)
-
-	for i := 0; i < len(dht.Lists[row]); i++ {
-
-		if isNodeOld(row, i) {
-			go pingNode(dht.Lists[row][i], pings, row, i)
-		} else {
-			pings <- 1
-		}
+	// the head was seen within the cache expiry, it is live and stays
+	if !rt.isNodeOld(row, 0) {
+		return -1, false
 	}
 
-	//waiting for mergeAllPings to complete
-	<-final
-
-	// return index of dead node
-	dead, i = checkForDeadNodes(row)
-	fmt.Println(dead, i)
-	if dead {
-		return i, ping
+	rt.pingNode(rt.getDHTVal(row, 0), row, 0)
+	if rt.getCacheVal(row, 0).Dead {
+		return 0, true
 	}
-	return -1, ping
+	return -1, true
 }
 
 //Listeners listens for add node requests for a particular i
 // i denotes a row of the DHT
-func Listeners(i int) {
+func (rt *RoutingTable) Listeners(i int) {
+	defer rt.workers.Done()
 	for {
-		nodePacket := <-channels.WriteChannel[i]
-		response := structures.AddNodeResponse{Ping: false, Input: false, ListIndex: i}
+		var nodePacket *structures.NodePacket
+		select {
+		case nodePacket = <-rt.channels.WriteChannel[i]:
+		case seen := <-rt.channels.SeenChannel[i]:
+			if new, j := rt.checkIfNew(&seen, i); !new {
+				rt.moveToTail(i, j)
+			}
+			continue
+		case <-rt.quit:
+			return
+		}
 		n := &(nodePacket.Node)
-		new, j := checkIfNew(n, i)
+		new, j := rt.checkIfNew(n, i)
+		if nodePacket.RemoveResponse != nil {
+			removeResponse := structures.RemoveNodeResponse{ListIndex: -1, Removed: false}
+			if !new {
+				rt.removeFromDHT(i, j)
+				removeResponse = structures.RemoveNodeResponse{ListIndex: i, Removed: true}
+			}
+			rt.removeReplacement(i, n.Key)
+
+			select {
+			case nodePacket.RemoveResponse <- removeResponse:
+				continue
+			case <-rt.quit:
+				return
+			}
+		}
+
+		response := structures.AddNodeResponse{Ping: false, Input: false, ListIndex: i}
 		if new {
-			if len(dht.Lists[i]) < bucketSize {
-				addInDHT(n, i)
+			if len(rt.dht.Lists[i]) < rt.bucketSize {
+				rt.addInDHT(n, i)
+				rt.removeReplacement(i, n.Key)
 				response.Input = true
-			} else if len(dht.Lists[i]) == bucketSize {
-				j, ping := checkAndUpdateCache(i)
+			} else if len(rt.dht.Lists[i]) == rt.bucketSize {
+				j, ping := rt.checkAndUpdateCache(i)
 				response.Ping = ping
 
 				if j != -1 {
-					replaceInDHT(n, i, j)
+					rt.replaceInDHT(n, i, j)
+					rt.removeReplacement(i, n.Key)
 					response.Input = true
+					// other nodes of the row may be known dead as well
+					rt.promoteReplacements(i)
+				} else {
+					rt.addReplacement(i, *n)
+					response.Replacement = true
 				}
 			} else {
 				panic("The bucket has more elements than bucket size !")
 			}
 		} else {
 			fmt.Println("Node exists!!")
-			updateCache(i, j, false)
+			rt.moveToTail(i, j)
 			response = structures.AddNodeResponse{
 				ListIndex: -1,
 				Ping:      false,
 				Input:     false,
 			}
 		}
-		nodePacket.NodeResponse <- response
+		select {
+		case nodePacket.NodeResponse <- response:
+		case <-rt.quit:
+			return
+		}
+	}
+}
+
+// addReplacement keeps the node as the freshest replacement candidate of the row.
+// The oldest candidate is dropped once the row has more than bucketSize candidates.
+func (rt *RoutingTable) addReplacement(row int, n structures.Node) {
+	rt.removeReplacement(row, n.Key)
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	rt.replacements.Lists[row] = append(rt.replacements.Lists[row], n)
+	if len(rt.replacements.Lists[row]) > rt.bucketSize {
+		rt.replacements.Lists[row] = rt.replacements.Lists[row][1:]
+	}
+}
+
+// removeReplacement removes the node from the replacement candidates of the row
+func (rt *RoutingTable) removeReplacement(row int, key structures.NodeID) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	candidates := rt.replacements.Lists[row]
+	for i := range candidates {
+		if candidates[i].Key == key {
+			rt.replacements.Lists[row] = append(candidates[:i:i], candidates[i+1:]...)
+			return
+		}
 	}
 }
 
+// popReplacement removes and returns the freshest replacement candidate of the row
+func (rt *RoutingTable) popReplacement(row int) (structures.Node, bool) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	candidates := rt.replacements.Lists[row]
+	if len(candidates) == 0 {
+		return structures.Node{}, false
+	}
+	n := candidates[len(candidates)-1]
+	rt.replacements.Lists[row] = candidates[:len(candidates)-1]
+	return n, true
+}
+
+// promoteReplacements replaces every dead node of the row with the freshest replacement candidate
+func (rt *RoutingTable) promoteReplacements(row int) {
+	for {
+		dead, j := rt.checkForDeadNodes(row)
+		if !dead {
+			return
+		}
+		n, ok := rt.popReplacement(row)
+		if !ok {
+			return
+		}
+		rt.replaceInDHT(&n, row, j)
+	}
+}
+
+/*
+Bucket returns the nodes of a row of the DHT ordered by when they were last seen,
+least recently seen first.
+
+Arguments:
+1. row: The row of the DHT
+Returns:
+1. []Node: Copy of the row
+*/
+func (rt *RoutingTable) Bucket(row int) []structures.Node {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	return append([]structures.Node(nil), rt.dht.Lists[row]...)
+}
+
+/*
+Replacements returns the replacement candidates of a row of the DHT, freshest last.
+
+Arguments:
+1. row: The row of the DHT
+Returns:
+1. []Node: Copy of the candidates
+*/
+func (rt *RoutingTable) Replacements(row int) []structures.Node {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	return append([]structures.Node(nil), rt.replacements.Lists[row]...)
+}
+
 // Sends value of node over to a particular row listener of DHT
-func routeToDHTRow(nodePacket *structures.NodePacket, row int) {
-	channels.WriteChannel[row] <- nodePacket
+func (rt *RoutingTable) routeToDHTRow(nodePacket *structures.NodePacket, row int) {
+	select {
+	case rt.channels.WriteChannel[row] <- nodePacket:
+	case <-rt.quit:
+	}
 }
 
-func checkIfNew(n *structures.Node, row int) (bool, int) {
-	for i := 0; i < len(dht.Lists[row]); i++ {
-		existing := getDHTVal(row, i)
+func (rt *RoutingTable) checkIfNew(n *structures.Node, row int) (bool, int) {
+	for i := 0; i < len(rt.dht.Lists[row]); i++ {
+		existing := rt.getDHTVal(row, i)
 		if existing.Key == n.Key {
 			return false, i
 		}
@@ -239,9 +733,9 @@ func checkIfNew(n *structures.Node, row int) (bool, int) {
 
 // GetRowNum is used to find the list number where the node is to be stored in the DHT
 // Node is the structure for the incoming node
-func GetRowNum(n *structures.Node) int {
+func (rt *RoutingTable) GetRowNum(n *structures.Node) int {
 	for i := 0; i < constants.NUM_BYTES; i++ {
-		val := uint8(nodedetails.MyNode.Key[i] ^ n.Key[i])
+		val := uint8(rt.self.Key[i] ^ n.Key[i])
 		if val != 0 {
 			return 8*i + bits.LeadingZeros8(val)
 		}
@@ -249,38 +743,102 @@ func GetRowNum(n *structures.Node) int {
 	return 1
 }
 
-// Updates value in cache to signify nodes livliness status
-func updateCache(row int, col int, status bool) {
-	c := structures.CacheObject{LastTime: time.Now(), Dead: status}
-	if col == -1 {
-		cache.Lists[row] = append(cache.Lists[row], c)
-	} else {
-		cache.Lists[row][col] = c
+// Updates value in cache to signify nodes livliness status. The node stays in place,
+// so the update is logged over its current position. A dead node keeps the time it
+// was last seen at.
+func (rt *RoutingTable) updateCache(row int, col int, status bool) {
+	rt.lock.Lock()
+	c := rt.cache.Lists[row][col]
+	c.Dead = status
+	if !status {
+		c.LastTime = time.Now()
 	}
+	rt.cache.Lists[row][col] = c
+	logged := rt.logMutation(row, col, false)
+	rt.lock.Unlock()
+
+	waitLogged(logged)
 }
 
-//storeDHT stores value into DHT. If col is -1 , it appends to the list of DHT
-func updateDHT(row int, col int, n *structures.Node) {
-	if col == -1 {
-		dht.Lists[row] = append(dht.Lists[row], *n)
-	} else {
-		dht.Lists[row][col] = *n
+func (rt *RoutingTable) getDHTVal(row int, col int) structures.Node {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	return rt.dht.Lists[row][col]
+}
+
+func (rt *RoutingTable) getCacheVal(row int, col int) structures.CacheObject {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	return rt.cache.Lists[row][col]
+}
+
+// markSeen reports to the row listener that a node in the DHT responded to a request,
+// refreshing its cache entry and moving it to the tail of its row. The report is dropped
+// if the queue of the row is full, as the row listener may itself be the one waiting on
+// this response.
+func (rt *RoutingTable) markSeen(n structures.Node) {
+	select {
+	case rt.channels.SeenChannel[rt.GetRowNum(&n)] <- n:
+	default:
 	}
 }
 
-func getDHTVal(row int, col int) structures.Node {
-	return dht.Lists[row][col]
+// xorDistance computes the Kademlia distance between two node keys
+func xorDistance(a structures.NodeID, b structures.NodeID) structures.NodeID {
+	var d structures.NodeID
+	for i := 0; i < constants.NUM_BYTES; i++ {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
 }
 
-func getCacheVal(row int, col int) structures.CacheObject {
-	return cache.Lists[row][col]
+// isCloser checks if key a is strictly closer to target than key b
+func isCloser(target structures.NodeID, a structures.NodeID, b structures.NodeID) bool {
+	da := xorDistance(target, a)
+	db := xorDistance(target, b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+/*
+FindClosestNodes finds the nodes in the DHT closest to the key by XOR distance.
+Nodes that the cache has marked dead are skipped.
+
+Arguments:
+1. key: The key to which distance is measured
+2. count: The max number of nodes to return
+Returns:
+1. []Node: Upto count nodes, sorted closest first
+*/
+func (rt *RoutingTable) FindClosestNodes(key structures.NodeID, count int) []structures.Node {
+	rt.lock.RLock()
+	var nodes []structures.Node
+	for row := 0; row < constants.HASH_SIZE; row++ {
+		for col, n := range rt.dht.Lists[row] {
+			if col < len(rt.cache.Lists[row]) && rt.cache.Lists[row][col].Dead {
+				continue
+			}
+			nodes = append(nodes, n)
+		}
+	}
+	rt.lock.RUnlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return isCloser(key, nodes[i].Key, nodes[j].Key)
+	})
+
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
 }
 
 // compute verifies the node so that it doesn't add an already inserted node
-func compute(nodePacket *structures.NodePacket) {
+func (rt *RoutingTable) compute(nodePacket *structures.NodePacket) {
 	n := &nodePacket.Node
-	row := GetRowNum(n)
-	routeToDHTRow(nodePacket, row)
+	row := rt.GetRowNum(n)
+	rt.routeToDHTRow(nodePacket, row)
 }
 
 func computeByte(key string) (uint8, error) {
@@ -289,41 +847,66 @@ func computeByte(key string) (uint8, error) {
 }
 
 // AddNode Adds the node into DHT and return Response indicating status
-func AddNode(domain string, port int, firstNodeIDByteString string) (chan structures.AddNodeResponse, error) {
+func (rt *RoutingTable) AddNode(domain string, port int, firstNodeIDByteString string) (chan structures.AddNodeResponse, error) {
 
 	firstByte, err := computeByte(firstNodeIDByteString)
 	if err != nil {
 		return nil, err
 	}
 
-	nodeResponse := make(chan structures.AddNodeResponse)
+	nodeResponse := rt.addNode(structures.Node{
+		Domain: domain,
+		Port:   port,
+		Key:    structures.NodeID{firstByte, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124},
+	})
+
+	return nodeResponse, err
+}
+
+/*
+AddNodeWithID adds the node with the full 256 bit key into the DHT.
+
+Arguments:
+1. domain: Domain of the node
+2. port: Port of the node
+3. key: The node id
+Returns:
+1. chan AddNodeResponse: The channel on which the response of the row listener is sent
+*/
+func (rt *RoutingTable) AddNodeWithID(domain string, port int, key structures.NodeID) chan structures.AddNodeResponse {
+	return rt.addNode(structures.Node{Domain: domain, Port: port, Key: key})
+}
+
+/*
+RemoveNode evicts the node with the key from the DHT and cache, writing a tombstone
+to the persistance log. The freshest replacement candidate of the row takes its place.
+
+Arguments:
+1. key: The node id
+Returns:
+1. chan RemoveNodeResponse: The channel on which the response of the row listener is sent
+*/
+func (rt *RoutingTable) RemoveNode(key structures.NodeID) chan structures.RemoveNodeResponse {
+	removeResponse := make(chan structures.RemoveNodeResponse)
 	value := structures.NodePacket{
-		Node: structures.Node{
-			Domain: domain,
-			Port:   port,
-			Key:    structures.NodeID{firstByte, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124},
-		},
-		NodeResponse: nodeResponse,
+		Node:           structures.Node{Key: key},
+		RemoveResponse: removeResponse,
 	}
 
-	go compute(&value)
+	go rt.compute(&value)
 
-	return nodeResponse, err
+	return removeResponse
 }
 
-//InitDHT Initializes the Data structures required by the DHT
-//size is the max number of nodes that can be saved in a list
-func InitDHT(size int, timeoutForCache float64) {
-	cacheExpiryMinutes = timeoutForCache
-	bucketSize = size
-	// Setting up DHT listeners
-	for i := 0; i < constants.HASH_SIZE; i++ {
-		channels.WriteChannel[i] = make(chan *structures.NodePacket)
-		go Listeners(i)
+// addNode sends the node to its row listener and returns the channel the response arrives on
+func (rt *RoutingTable) addNode(n structures.Node) chan structures.AddNodeResponse {
+	nodeResponse := make(chan structures.AddNodeResponse)
+	value := structures.NodePacket{
+		Node:         n,
+		NodeResponse: nodeResponse,
 	}
 
-	// switch on persistance
+	go rt.compute(&value)
 
-	// persistance.InitPersistance()
-	// go PeriodicSyncDHT(nil, 5*time.Second)
+	return nodeResponse
 }
@@ -1,17 +1,53 @@
 package dht_test
 
 import (
+	"bytes"
+	"fmt"
 	"hydra-dht/dht"
+	"hydra-dht/persistance"
+	"hydra-dht/structures"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
+// key of the node owning the routing tables under test
+var selfKey = structures.NodeID{255, 4, 67, 24, 12, 34, 234, 24, 12, 34, 234, 24, 12, 34, 234, 24, 12, 34, 234, 24, 12, 34, 234, 24, 12, 34, 234, 24, 12, 34, 234, 24}
+
+// newTestTable creates a routing table with 2 nodes per list and the given cache timeout
+func newTestTable(timeoutForCache float64) *dht.RoutingTable {
+	rt, _ := dht.New(selfKey, dht.Options{
+		BucketSize:         2,
+		CacheExpiryMinutes: timeoutForCache,
+		Domain:             "127.0.0.1",
+		Port:               1200,
+	})
+	return rt
+}
+
+// testKey returns the key of a test node, test keys differ in their first byte only
+func testKey(firstByte uint8) structures.NodeID {
+	return structures.NodeID{firstByte, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124}
+}
+
+// addTestNodes adds nodes with the given first key bytes into the routing table
+func addTestNodes(rt *dht.RoutingTable, firstBytes []uint8) {
+	for _, firstByte := range firstBytes {
+		key := testKey(firstByte)
+		<-rt.AddNodeWithID("127.0.0.1", 80, key)
+	}
+}
+
 func TestAddNode(t *testing.T) {
 
 	//nodeKey := "1111111"
 	//maxNodeInList := 2
 	// time out 0.6 seconds
-	dht.InitDHT(2, .01)
+	rt := newTestTable(.01)
+	defer rt.Close()
 
 	var tests = []struct {
 		nodeId    string
@@ -35,7 +71,7 @@ func TestAddNode(t *testing.T) {
 		if test.sleep {
 			time.Sleep(1 * time.Second)
 		}
-		channel, err := dht.AddNode("127.0.0.1", 80, test.nodeId)
+		channel, err := rt.AddNode("127.0.0.1", 80, test.nodeId)
 
 		if err != nil {
 
@@ -62,21 +98,360 @@ func TestAddNode(t *testing.T) {
 
 }
 
+func TestBucketOrder(t *testing.T) {
+	// nodes don't expire, so the head of a full bucket is never pinged
+	rt := newTestTable(60)
+	defer rt.Close()
+
+	var tests = []struct {
+		firstByte uint8
+		bucket    []uint8
+	}{
+		{127, []uint8{127}},
+		{126, []uint8{127, 126}},
+		{127, []uint8{126, 127}}, // seen again, moves to tail
+		{125, []uint8{126, 127}}, // bucket full, the head isn't pinged and stays, the newcomer waits
+	}
+	for _, test := range tests {
+		addTestNodes(rt, []uint8{test.firstByte})
+
+		bucket := rt.Bucket(0)
+		if len(bucket) != len(test.bucket) {
+			t.Errorf("Bucket => got %d nodes; want %d", len(bucket), len(test.bucket))
+			continue
+		}
+		for i, firstByte := range test.bucket {
+			if bucket[i].Key[0] != firstByte {
+				t.Errorf("Bucket => (KEY %d)= %v;want %v", i, bucket[i].Key[0], firstByte)
+			}
+		}
+	}
+	if replacements := rt.Replacements(0); len(replacements) != 1 || replacements[0].Key[0] != 125 {
+		t.Errorf("Replacements => %v;want the newcomer 125", replacements)
+	}
+
+	// the head never heard from isn't made any fresher by newcomers
+	head := rt.Export().Nodes[0]
+	addTestNodes(rt, []uint8{124})
+	if after := rt.Export().Nodes[0]; after.NodeID != head.NodeID || !after.LastSeen.Equal(*head.LastSeen) {
+		t.Errorf("head after a newcomer => %s seen %v;want %s seen %v", after.NodeID, after.LastSeen, head.NodeID, head.LastSeen)
+	}
+}
+
+func TestReplacements(t *testing.T) {
+	// nodes don't expire, so a full bucket keeps all its nodes
+	rt := newTestTable(60)
+	defer rt.Close()
+	addTestNodes(rt, []uint8{127, 126})
+
+	var tests = []struct {
+		firstByte    uint8
+		replacements []uint8
+	}{
+		{125, []uint8{125}},
+		{124, []uint8{125, 124}},
+		{125, []uint8{124, 125}}, // seen again, moves to freshest
+		{123, []uint8{125, 123}}, // oldest is dropped
+	}
+	for _, test := range tests {
+		key := testKey(test.firstByte)
+		actual := <-rt.AddNodeWithID("127.0.0.1", 80, key)
+		if actual.Input || !actual.Replacement {
+			t.Errorf("AddNodeWithID(%v) => (INPUT)= %v;want false | (REPLACEMENT)= %v;want true", test.firstByte, actual.Input, actual.Replacement)
+		}
+
+		replacements := rt.Replacements(0)
+		if len(replacements) != len(test.replacements) {
+			t.Errorf("Replacements => got %d nodes; want %d", len(replacements), len(test.replacements))
+			continue
+		}
+		for i, firstByte := range test.replacements {
+			if replacements[i].Key[0] != firstByte {
+				t.Errorf("Replacements => (KEY %d)= %v;want %v", i, replacements[i].Key[0], firstByte)
+			}
+		}
+	}
+}
+
+func TestRemoveNode(t *testing.T) {
+	rt := newTestTable(60)
+	defer rt.Close()
+	// 125 ends up as a replacement candidate of the full bucket
+	addTestNodes(rt, []uint8{127, 126, 125})
+
+	var tests = []struct {
+		firstByte uint8
+		listIndex int
+		removed   bool
+		bucket    []uint8
+	}{
+		{126, 0, true, []uint8{127, 125}}, // replacement is promoted
+		{126, -1, false, []uint8{127, 125}},
+		{127, 0, true, []uint8{125}},
+	}
+	for _, test := range tests {
+		key := testKey(test.firstByte)
+		actual := <-rt.RemoveNode(key)
+		if actual.ListIndex != test.listIndex || actual.Removed != test.removed {
+			t.Errorf("RemoveNode(%v) => (INDEX)= %v;want %v | (REMOVED)= %v;want %v",
+				test.firstByte, actual.ListIndex, test.listIndex, actual.Removed, test.removed)
+		}
+
+		bucket := rt.Bucket(0)
+		if len(bucket) != len(test.bucket) {
+			t.Errorf("Bucket => got %d nodes; want %d", len(bucket), len(test.bucket))
+			continue
+		}
+		for i, firstByte := range test.bucket {
+			if bucket[i].Key[0] != firstByte {
+				t.Errorf("Bucket => (KEY %d)= %v;want %v", i, bucket[i].Key[0], firstByte)
+			}
+		}
+	}
+}
+
+func TestFindClosestNodes(t *testing.T) {
+	rt := newTestTable(60)
+	defer rt.Close()
+	addTestNodes(rt, []uint8{127, 221, 223})
+
+	target := testKey(223)
+
+	var tests = []struct {
+		count     int
+		firstKeys []uint8
+	}{
+		{1, []uint8{223}},
+		{2, []uint8{223, 221}},
+		{3, []uint8{223, 221, 127}},
+	}
+	for _, test := range tests {
+		nodes := rt.FindClosestNodes(target, test.count)
+		if len(nodes) != test.count {
+			t.Errorf("FindClosestNodes(%d) => got %d nodes", test.count, len(nodes))
+			continue
+		}
+		for i, firstKey := range test.firstKeys {
+			if nodes[i].Key[0] != firstKey {
+				t.Errorf("FindClosestNodes(%d) => (KEY %d)= %v;want %v", test.count, i, nodes[i].Key[0], firstKey)
+			}
+		}
+	}
+}
+
+func TestLookupUnreachable(t *testing.T) {
+	rt := newTestTable(60)
+	defer rt.Close()
+	// all the nodes point to a port with no node running
+	addTestNodes(rt, []uint8{127, 221, 223})
+
+	target := testKey(223)
+
+	nodes := rt.Lookup(target)
+	if len(nodes) != 0 {
+		t.Errorf("Lookup => got %d nodes; want 0 as no node responds", len(nodes))
+	}
+}
+
+// waitForSnapshot waits upto 2 seconds for a snapshot taken after the given time
+func waitForSnapshot(rt *dht.RoutingTable, after time.Time) persistance.Stats {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats, _ := rt.PersistanceStats()
+		if stats.LastSnapshot.After(after) || time.Now().After(deadline) {
+			return stats
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestPeriodicSync(t *testing.T) {
-	// TODO
-	i := 1
-	duration := time.Duration(i) * time.Second
+	dir, err := ioutil.TempDir("", "hydra-dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
 
-	c := make(chan int)
 	ti := time.Now()
+	rt, err := dht.New(selfKey, dht.Options{BucketSize: 2, CacheExpiryMinutes: 60, DataDir: dir, SyncInterval: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+	addTestNodes(rt, []uint8{1})
+
+	if stats := waitForSnapshot(rt, ti); !stats.LastSnapshot.After(ti) {
+		t.Errorf("LastSnapshot => %v;want a sync within the sync interval", stats.LastSnapshot)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	// the sync interval is never up, only the log size triggers a sync
+	rt, err := dht.New(selfKey, dht.Options{BucketSize: 2, CacheExpiryMinutes: 60, Backend: persistance.NewMemoryBackend(), SyncInterval: time.Hour, CompactLogRecords: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+
+	stats, ok := rt.PersistanceStats()
+	if !ok {
+		t.Fatal("PersistanceStats => persistance off;want on")
+	}
+	recovered := stats.LastSnapshot
+	addTestNodes(rt, []uint8{1, 2})
+
+	stats = waitForSnapshot(rt, recovered)
+	if !stats.LastSnapshot.After(recovered) || stats.LogRecords != 0 {
+		t.Errorf("PersistanceStats => %+v;want a snapshot once the log held 2 records", stats)
+	}
+}
+
+func TestSyncSkippedWhenUnchanged(t *testing.T) {
+	rt, err := dht.New(selfKey, dht.Options{BucketSize: 2, CacheExpiryMinutes: 60, Backend: persistance.NewMemoryBackend(), SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+
+	stats, _ := rt.PersistanceStats()
+	recovered := stats.LastSnapshot
+	// several sync intervals go by
+	time.Sleep(100 * time.Millisecond)
+	if stats, _ = rt.PersistanceStats(); !stats.LastSnapshot.Equal(recovered) {
+		t.Errorf("LastSnapshot => %v;want no snapshot of an unchanged table", stats.LastSnapshot)
+	}
 
-	go dht.PeriodicSyncDHT(c, duration)
+	addTestNodes(rt, []uint8{1})
+	if stats = waitForSnapshot(rt, recovered); !stats.LastSnapshot.After(recovered) {
+		t.Errorf("LastSnapshot => %v;want a snapshot once the table changed", stats.LastSnapshot)
+	}
+}
+
+func TestSeenNodeLogged(t *testing.T) {
+	backend := persistance.NewMemoryBackend()
+	rt, err := dht.New(selfKey, dht.Options{BucketSize: 2, CacheExpiryMinutes: 60, Backend: backend, SyncInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestNodes(rt, []uint8{126, 127})
+	before, _ := rt.PersistanceStats()
 
-	select {
-	case <-c:
-		if time.Since(ti).Seconds() >= float64(i+1) {
-			t.Errorf("%v", time.Since(ti).Seconds())
+	// a node seen again moves to the tail with a single record
+	addTestNodes(rt, []uint8{126})
+	if stats, _ := rt.PersistanceStats(); stats.LogRecords != before.LogRecords+1 {
+		t.Errorf("LogRecords after a node was seen => %d;want %d", stats.LogRecords, before.LogRecords+1)
+	}
+	rt.Close()
+
+	rt, err = dht.New(selfKey, dht.Options{BucketSize: 2, CacheExpiryMinutes: 60, Backend: backend, SyncInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+	if bucket := rt.Bucket(0); len(bucket) != 2 || bucket[0].Key[0] != 127 || bucket[1].Key[0] != 126 {
+		t.Errorf("recovered Bucket => %v;want the seen node at the tail", bucket)
+	}
+}
+
+func TestStrictRecovery(t *testing.T) {
+	backend := persistance.NewMemoryBackend()
+	backend.WriteSnapshot("dht-1", []byte("garbage"))
+
+	_, err := dht.New(selfKey, dht.Options{BucketSize: 2, CacheExpiryMinutes: 60, Backend: backend, StrictRecovery: true})
+	if _, ok := err.(*persistance.RecoveryError); !ok {
+		t.Errorf("New => %v;want a recovery error for the unreadable dht file", err)
+	}
+
+	rt, err := dht.New(selfKey, dht.Options{BucketSize: 2, CacheExpiryMinutes: 60, Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+	report, _ := rt.RecoveryReport()
+	if len(report.Discarded) != 1 || report.Discarded[0].Name != "dht-1" {
+		t.Errorf("RecoveryReport => discarded %v;want dht-1", report.Discarded)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	rt := newTestTable(60)
+	defer rt.Close()
+	addTestNodes(rt, []uint8{1, 2, 3, 128})
+	<-rt.RemoveNode(testKey(128))
+
+	var exported bytes.Buffer
+	if err := rt.ExportJSON(&exported); err != nil {
+		t.Fatal(err)
+	}
+	table := rt.Export()
+	if len(table.Nodes) != 2 || table.NodeID != selfKey.Hex() || table.Nodes[0].Bucket != 0 || table.Nodes[0].LastSeen == nil {
+		t.Errorf("Export => %+v;want the 2 nodes of bucket 0 with their cache", table)
+	}
+
+	imported := newTestTable(60)
+	defer imported.Close()
+	result, err := imported.ImportJSON(&exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 2 || fmt.Sprint(imported.Bucket(0)) != fmt.Sprint(rt.Bucket(0)) {
+		t.Errorf("ImportJSON => %+v, bucket 0 %v;want %v", result, imported.Bucket(0), rt.Bucket(0))
+	}
+
+	// the nodes of closest_nodes.json share a key, so only the first is added
+	file, err := os.Open("../testdata/closest_nodes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	result, err = imported.ImportJSON(file)
+	if err != nil || result.Added != 1 || result.Rejected != 2 {
+		t.Errorf("ImportJSON(closest_nodes.json) => %+v | (ERROR)= %v;want 1 added and 2 rejected", result, err)
+	}
+
+	_, err = imported.ImportJSON(strings.NewReader(`{"nodes": [{"nodeId": "zz"}]}`))
+	if err == nil {
+		t.Errorf("ImportJSON(invalid node id) => nil error;want an error")
+	}
+}
+
+func TestDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydra-dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := dht.Options{BucketSize: 2, CacheExpiryMinutes: 60, DataDir: filepath.Join(dir, "node-a")}
+	rt, err := dht.New(selfKey, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestNodes(rt, []uint8{1, 2})
+	rt.Close()
+
+	for _, folder := range []string{"log", "dht"} {
+		if _, err := os.Stat(filepath.Join(opts.DataDir, folder)); err != nil {
+			t.Errorf("%s folder => %v; want it created in the data dir", folder, err)
 		}
 	}
 
+	// a node with another data dir starts out empty
+	other, err := dht.New(selfKey, dht.Options{BucketSize: 2, CacheExpiryMinutes: 60, DataDir: filepath.Join(dir, "node-b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := other.FindClosestNodes(selfKey, 20); len(nodes) != 0 {
+		t.Errorf("other data dir => got %d nodes; want 0", len(nodes))
+	}
+	other.Close()
+
+	restored, err := dht.New(selfKey, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if nodes := restored.Bucket(0); len(nodes) != 2 {
+		t.Errorf("restored bucket => got %d nodes; want 2", len(nodes))
+	}
 }
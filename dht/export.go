@@ -0,0 +1,134 @@
+package dht
+
+import (
+	"encoding/json"
+	"fmt"
+	"hydra-dht/constants"
+	structures "hydra-dht/structures"
+	"io"
+	"time"
+)
+
+// ExportedNode is a node of an exported routing table. The port, domain and nodeId
+// fields are those of testdata/closest_nodes.json, so a list of nodes in that format
+// can be imported as well.
+type ExportedNode struct {
+	Port   int    `json:"port"`
+	Domain string `json:"domain"`
+	NodeID string `json:"nodeId"`
+	// Bucket is the row of the DHT the node is in, relative to the exporting node
+	Bucket int `json:"bucket"`
+	// LastSeen is when the node last responded, nil if never
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+	Dead     bool       `json:"dead,omitempty"`
+}
+
+// ExportedTable is the JSON export of the DHT and cache of a routing table. The nodes
+// are listed bucket by bucket, least recently seen first in each bucket.
+type ExportedTable struct {
+	// NodeID is the hex key of the node the table was exported from
+	NodeID string         `json:"nodeId,omitempty"`
+	Nodes  []ExportedNode `json:"nodes"`
+}
+
+// ImportResult tells what became of the nodes of an imported table
+type ImportResult struct {
+	// Added are the nodes inserted into the DHT
+	Added int
+	// Replacements are the nodes kept as replacement candidates of a full bucket
+	Replacements int
+	// Rejected are the nodes the DHT turned down or already had, and the dead nodes
+	// or current node skipped
+	Rejected int
+}
+
+/*
+ExportTable exports the DHT and its cache.
+
+Arguments:
+1. self: Key of the node the DHT belongs to
+2. dht: The DHT
+3. cache: The cache of the DHT, its lists are of the same length as the DHT's
+Returns:
+1. ExportedTable: The exported table
+*/
+func ExportTable(self structures.NodeID, dht *structures.DHT, cache *structures.Cache) ExportedTable {
+	table := ExportedTable{NodeID: self.Hex(), Nodes: []ExportedNode{}}
+	for row := 0; row < constants.HASH_SIZE; row++ {
+		for col, n := range dht.Lists[row] {
+			node := ExportedNode{Port: n.Port, Domain: n.Domain, NodeID: n.Key.Hex(), Bucket: row}
+			if col < len(cache.Lists[row]) {
+				c := cache.Lists[row][col]
+				if !c.LastTime.IsZero() {
+					lastSeen := c.LastTime
+					node.LastSeen = &lastSeen
+				}
+				node.Dead = c.Dead
+			}
+			table.Nodes = append(table.Nodes, node)
+		}
+	}
+	return table
+}
+
+// Export exports the DHT and cache of the routing table
+func (rt *RoutingTable) Export() ExportedTable {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	return ExportTable(rt.self.Key, &rt.dht, &rt.cache)
+}
+
+// ExportJSON writes the export of the routing table as indented JSON, read documentation of ExportedTable
+func (rt *RoutingTable) ExportJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	return encoder.Encode(rt.Export())
+}
+
+/*
+ImportJSON imports the nodes of an exported table into the routing table, for
+example to seed a fresh node from a known good table. Every node is fed through
+the row listeners like AddNodeWithID, so buckets are recomputed for the current
+node and full buckets ping their least recently seen node as usual. Nodes marked
+dead in the export are skipped. Nothing is imported if any node id is invalid.
+
+Arguments:
+1. r: The JSON of an ExportedTable, or a list of nodes like testdata/closest_nodes.json
+Returns:
+1. ImportResult: What became of the nodes
+2. error: Error in decoding the table, nil if no error
+*/
+func (rt *RoutingTable) ImportJSON(r io.Reader) (ImportResult, error) {
+	var result ImportResult
+	var table ExportedTable
+	if err := json.NewDecoder(r).Decode(&table); err != nil {
+		return result, err
+	}
+
+	nodes := make([]structures.Node, len(table.Nodes))
+	for i, n := range table.Nodes {
+		key, err := structures.ParseNodeIDHex(n.NodeID)
+		if err != nil {
+			return result, fmt.Errorf("node %d: %v", i, err)
+		}
+		nodes[i] = structures.Node{Key: key, Domain: n.Domain, Port: n.Port}
+	}
+
+	for i, n := range nodes {
+		if n.Key == rt.self.Key || table.Nodes[i].Dead {
+			result.Rejected++
+			continue
+		}
+		response := rt.insertNode(n)
+		switch {
+		case response.Input:
+			result.Added++
+		case response.Replacement:
+			result.Replacements++
+		default:
+			result.Rejected++
+		}
+	}
+	return result, nil
+}
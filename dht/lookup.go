@@ -0,0 +1,198 @@
+package dht
+
+import (
+	"hydra-dht/constants"
+	structures "hydra-dht/structures"
+	"sort"
+	"time"
+)
+
+// lookupEntry is a node in the shortlist of a lookup along with its query state
+type lookupEntry struct {
+	node      structures.Node
+	queried   bool
+	responded bool
+	failed    bool
+}
+
+// lookupResult is the response of a single call made during a lookup
+type lookupResult struct {
+	entry  *lookupEntry
+	closer []structures.Node
+	value  []byte
+	found  bool
+	err    error
+}
+
+// shortlist keeps the nodes seen during a lookup, sorted by distance to target
+type shortlist struct {
+	self    structures.NodeID
+	target  structures.NodeID
+	entries []*lookupEntry
+	seen    map[structures.NodeID]bool
+}
+
+func newShortlist(self structures.NodeID, target structures.NodeID) *shortlist {
+	return &shortlist{self: self, target: target, seen: make(map[structures.NodeID]bool)}
+}
+
+// add inserts nodes not seen before into the shortlist. The node itself is never added.
+func (s *shortlist) add(nodes []structures.Node) {
+	for _, n := range nodes {
+		if n.Key == s.self || s.seen[n.Key] {
+			continue
+		}
+		s.seen[n.Key] = true
+		s.entries = append(s.entries, &lookupEntry{node: n})
+	}
+	sort.Slice(s.entries, func(i, j int) bool {
+		return isCloser(s.target, s.entries[i].node.Key, s.entries[j].node.Key)
+	})
+}
+
+// closest returns the k closest entries that have not failed to respond
+func (s *shortlist) closest(k int) []*lookupEntry {
+	var entries []*lookupEntry
+	for _, e := range s.entries {
+		if len(entries) == k {
+			break
+		}
+		if !e.failed {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// responded returns the nodes of the k closest entries that have responded
+func (s *shortlist) responded(k int) []structures.Node {
+	var nodes []structures.Node
+	for _, e := range s.closest(k) {
+		if e.responded {
+			nodes = append(nodes, e.node)
+		}
+	}
+	return nodes
+}
+
+// queryNode sends a FindNodes or FindValue request to the entry's node and reports back on results
+func (rt *RoutingTable) queryNode(e *lookupEntry, target structures.NodeID, findValue bool, results chan lookupResult) {
+	result := lookupResult{entry: e}
+	if findValue {
+		result.value, result.found, result.closer, result.err = rt.findValueAt(e.node, target)
+	} else {
+		result.closer, result.err = rt.FindNodes(e.node, target)
+	}
+	results <- result
+}
+
+/*
+iterativeLookup performs an iterative Kademlia lookup for the target key.
+
+It seeds a shortlist from the local DHT and keeps upto ALPHA calls in flight to
+the closest nodes not yet queried. The closer nodes returned are merged into the
+shortlist. Nodes that fail to respond are dropped. The lookup terminates once the
+K closest nodes in the shortlist have all responded, or when findValue is set and
+a node returns the value.
+
+Arguments:
+1. target: The key being looked up
+2. findValue: Whether to send FindValue instead of FindNodes requests
+Returns:
+1. []Node: Upto K_BUCKET_SIZE responsive nodes closest to target, sorted closest first
+2. []byte: The value if found, nil otherwise
+3. bool: Whether the value was found
+*/
+func (rt *RoutingTable) iterativeLookup(target structures.NodeID, findValue bool) ([]structures.Node, []byte, bool) {
+	rt.touchRow(target)
+
+	list := newShortlist(rt.self.Key, target)
+	list.add(rt.FindClosestNodes(target, constants.K_BUCKET_SIZE))
+
+	// buffered so that calls still in flight once the value is found don't block
+	results := make(chan lookupResult, constants.ALPHA)
+	inFlight := 0
+
+	for {
+		for _, e := range list.closest(constants.K_BUCKET_SIZE) {
+			if inFlight == constants.ALPHA {
+				break
+			}
+			if !e.queried {
+				e.queried = true
+				inFlight++
+				go rt.queryNode(e, target, findValue, results)
+			}
+		}
+
+		// every node in the k closest has been queried and answered
+		if inFlight == 0 {
+			break
+		}
+
+		result := <-results
+		inFlight--
+		if result.err != nil {
+			result.entry.failed = true
+			continue
+		}
+		result.entry.responded = true
+		if result.found {
+			return list.responded(constants.K_BUCKET_SIZE), result.value, true
+		}
+		list.add(result.closer)
+	}
+
+	return list.responded(constants.K_BUCKET_SIZE), nil, false
+}
+
+/*
+Lookup performs an iterative node lookup for the target key. Read documentation
+for iterativeLookup for more information.
+
+Arguments:
+1. target: The key being looked up
+Returns:
+1. []Node: Upto K_BUCKET_SIZE responsive nodes closest to target, sorted closest first
+*/
+func (rt *RoutingTable) Lookup(target structures.NodeID) []structures.Node {
+	nodes, _, _ := rt.iterativeLookup(target, false)
+	return nodes
+}
+
+/*
+FindValue performs an iterative value lookup for the key. It returns the value as
+soon as any node has it, else the closest nodes found to the key.
+
+Arguments:
+1. key: The key of the value
+Returns:
+1. []byte: The value, nil if not found
+2. []Node: The closest responsive nodes to key found during the lookup
+3. bool: Whether the value was found
+*/
+func (rt *RoutingTable) FindValue(key structures.NodeID) ([]byte, []structures.Node, bool) {
+	nodes, value, found := rt.iterativeLookup(key, true)
+	return value, nodes, found
+}
+
+/*
+StoreValue publishes a key value pair on the K closest nodes to key in the network.
+
+Arguments:
+1. key: The key of the value, typically a content hash
+2. value: The value to be stored
+3. ttl: Duration after which nodes may expire the value
+Returns:
+1. int: The number of nodes that stored the value
+*/
+func (rt *RoutingTable) StoreValue(key structures.NodeID, value []byte, ttl time.Duration) int {
+	stored := 0
+	for _, n := range rt.Lookup(key) {
+		ok, err := rt.storeAt(n, key, value, ttl)
+		if err == nil && ok {
+			stored++
+		}
+	}
+	return stored
+}
@@ -0,0 +1,428 @@
+package dht_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hydra-dht/constants"
+	"hydra-dht/dht"
+	"hydra-dht/persistance"
+	pb "hydra-dht/protobuf/node"
+	"hydra-dht/structures"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// fakeNetwork runs in-process NodeDiscovery peers with scripted replies and records
+// the requests made to them. Nodes are known by the first byte of their test key.
+type fakeNetwork struct {
+	t       *testing.T
+	nodes   map[uint8]structures.Node
+	peers   map[uint8]*fakePeer
+	servers []*grpc.Server
+
+	lock        sync.Mutex
+	events      []event
+	inFlight    int
+	maxInFlight int
+}
+
+// event is a request reaching a peer or the peer replying to it
+type event struct {
+	key   uint8
+	reply bool
+}
+
+// fakePeer is a peer of the fake network
+type fakePeer struct {
+	network *fakeNetwork
+	key     uint8
+	// closer are the nodes the peer replies to FindNodes and FindValue with
+	closer []uint8
+	// value is the value the peer replies to FindValue with, nil if it has none
+	value []byte
+	// failing peers reply to every request with an error
+	failing bool
+	// stored are the Store requests the peer received
+	stored []*pb.StoreRequest
+}
+
+func newFakeNetwork(t *testing.T) *fakeNetwork {
+	return &fakeNetwork{t: t, nodes: make(map[uint8]structures.Node), peers: make(map[uint8]*fakePeer)}
+}
+
+// start serves the peer on a free port of the loopback interface
+func (network *fakeNetwork) start(peer *fakePeer) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		network.t.Fatal(err)
+	}
+	peer.network = network
+	network.peers[peer.key] = peer
+	network.nodes[peer.key] = structures.Node{Key: testKey(peer.key), Domain: "127.0.0.1", Port: lis.Addr().(*net.TCPAddr).Port}
+
+	server := grpc.NewServer()
+	pb.RegisterNodeDiscoveryServer(server, peer)
+	network.servers = append(network.servers, server)
+	go server.Serve(lis)
+}
+
+// addDead adds a node no peer listens for, requests to it fail to connect
+func (network *fakeNetwork) addDead(key uint8) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		network.t.Fatal(err)
+	}
+	lis.Close()
+	network.nodes[key] = structures.Node{Key: testKey(key), Domain: "127.0.0.1", Port: lis.Addr().(*net.TCPAddr).Port}
+}
+
+func (network *fakeNetwork) close() {
+	for _, server := range network.servers {
+		server.Stop()
+	}
+}
+
+// seed adds the nodes into the routing table
+func (network *fakeNetwork) seed(rt *dht.RoutingTable, keys []uint8) {
+	for _, key := range keys {
+		n := network.nodes[key]
+		<-rt.AddNodeWithID(n.Domain, n.Port, n.Key)
+	}
+}
+
+// begin records a request reaching the peer, which is held for a while so that
+// the requests of a lookup overlap
+func (network *fakeNetwork) begin(key uint8) {
+	network.lock.Lock()
+	network.events = append(network.events, event{key: key})
+	network.inFlight++
+	if network.inFlight > network.maxInFlight {
+		network.maxInFlight = network.inFlight
+	}
+	network.lock.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+}
+
+// end records the peer replying to a request
+func (network *fakeNetwork) end(key uint8) {
+	network.lock.Lock()
+	network.events = append(network.events, event{key: key, reply: true})
+	network.inFlight--
+	network.lock.Unlock()
+}
+
+// queried returns the nodes in the order they were sent requests
+func (network *fakeNetwork) queried() []uint8 {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	var keys []uint8
+	for _, e := range network.events {
+		if !e.reply {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+// index returns the position of the event in the record, -1 if it never happened
+func (network *fakeNetwork) index(e event) int {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	for i := range network.events {
+		if network.events[i] == e {
+			return i
+		}
+	}
+	return -1
+}
+
+func (network *fakeNetwork) pbNodes(keys []uint8) []*pb.Node {
+	var pbNodes []*pb.Node
+	for _, key := range keys {
+		n := network.nodes[key]
+		pbNodes = append(pbNodes, &pb.Node{NodeId: n.Key[:], Domain: n.Domain, Port: int32(n.Port)})
+	}
+	return pbNodes
+}
+
+func (peer *fakePeer) FindNodes(ctx context.Context, request *pb.FindNodesRequest) (*pb.CloserNodes, error) {
+	peer.network.begin(peer.key)
+	defer peer.network.end(peer.key)
+	if peer.failing {
+		return nil, errors.New("scripted failure")
+	}
+	return &pb.CloserNodes{Nodes: peer.network.pbNodes(peer.closer)}, nil
+}
+
+func (peer *fakePeer) Ping(ctx context.Context, node *pb.Node) (*pb.PingResponse, error) {
+	return &pb.PingResponse{Alive: !peer.failing}, nil
+}
+
+func (peer *fakePeer) Store(ctx context.Context, request *pb.StoreRequest) (*pb.StoreResponse, error) {
+	if peer.failing {
+		return nil, errors.New("scripted failure")
+	}
+	peer.network.lock.Lock()
+	peer.stored = append(peer.stored, request)
+	peer.network.lock.Unlock()
+	return &pb.StoreResponse{Stored: true}, nil
+}
+
+func (peer *fakePeer) FindValue(ctx context.Context, request *pb.FindValueRequest) (*pb.FindValueResponse, error) {
+	peer.network.begin(peer.key)
+	defer peer.network.end(peer.key)
+	if peer.failing {
+		return nil, errors.New("scripted failure")
+	}
+	if peer.value != nil {
+		return &pb.FindValueResponse{Found: true, Value: peer.value}, nil
+	}
+	return &pb.FindValueResponse{CloserNodes: peer.network.pbNodes(peer.closer)}, nil
+}
+
+// keyRange returns the first key bytes from first to last
+func keyRange(first uint8, last uint8) []uint8 {
+	var keys []uint8
+	for key := first; key <= last; key++ {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// firstBytes returns the first key byte of every node
+func firstBytes(nodes []structures.Node) []uint8 {
+	var keys []uint8
+	for _, n := range nodes {
+		keys = append(keys, n.Key[0])
+	}
+	return keys
+}
+
+func TestLookup(t *testing.T) {
+	network := newFakeNetwork(t)
+	defer network.close()
+
+	// the target is testKey(0), so the smaller the first byte the closer the node.
+	// Each seed returns the same 24 nodes closer than itself and a dead node. Those
+	// return nodes farther than the seeds, and 0x10 a node closer than all of them.
+	seeds := []uint8{0x80, 0x81, 0x82, 0xc0}
+	near := keyRange(0x10, 0x27)
+	far := keyRange(0x90, 0x9f)
+
+	network.addDead(0x01)
+	for _, key := range far {
+		network.start(&fakePeer{key: key})
+	}
+	network.start(&fakePeer{key: 0x08, closer: far})
+	for _, key := range near {
+		closer := far
+		if key == 0x10 {
+			closer = append([]uint8{0x08}, far...)
+		}
+		network.start(&fakePeer{key: key, closer: closer, failing: key == 0x11})
+	}
+	for _, key := range seeds {
+		network.start(&fakePeer{key: key, closer: append([]uint8{0x01}, near...)})
+	}
+
+	rt, err := dht.New(selfKey, dht.Options{BucketSize: 4, CacheExpiryMinutes: 60, Domain: "127.0.0.1", Port: 1200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+	network.seed(rt, seeds)
+
+	// the k closest that answered, without the dead and the failing node
+	want := append([]uint8{0x08, 0x10}, keyRange(0x12, 0x23)...)
+	if nodes := firstBytes(rt.Lookup(testKey(0))); !bytes.Equal(nodes, want) {
+		t.Errorf("Lookup => %x;want %x", nodes, want)
+	}
+
+	if network.maxInFlight > constants.ALPHA {
+		t.Errorf("Lookup had %d requests in flight;want at most %d", network.maxInFlight, constants.ALPHA)
+	}
+
+	// every node is queried at most once. 0x24 is among the k closest only if both
+	// failures come back before 0x08 is known, 0xc0, 0x25 to 0x27 and the far nodes
+	// never are as the lookup only goes closer once a seed replied
+	queried := network.queried()
+	wantQueried := append(append([]uint8{0x08}, keyRange(0x10, 0x23)...), 0x80, 0x81, 0x82)
+	for _, key := range wantQueried {
+		if n := bytes.Count(queried, []byte{key}); n != 1 {
+			t.Errorf("Lookup queried %x %d times;want once", key, n)
+		}
+	}
+	if n := len(queried) - bytes.Count(queried, []byte{0x24}); n != len(wantQueried) || len(queried) > n+1 {
+		t.Errorf("Lookup queried %x;want each of %x once and 24 at most once", queried, wantQueried)
+	}
+
+	// only the ALPHA closest seeds are queried before any reply
+	network.lock.Lock()
+	for _, e := range network.events {
+		if e.reply {
+			break
+		}
+		if e.key != 0x80 && e.key != 0x81 && e.key != 0x82 {
+			t.Errorf("Lookup queried %x before any reply", e.key)
+		}
+	}
+	network.lock.Unlock()
+
+	// 0x08 is only known from the reply of 0x10
+	if network.index(event{key: 0x08}) < network.index(event{key: 0x10, reply: true}) {
+		t.Errorf("Lookup queried 08 before 10 replied with it")
+	}
+}
+
+// newValueNetwork starts seeds 0x80 to 0x82 that return the nodes 0x10 to 0x1f, of
+// which the holders have value. The routing table knows the seeds only.
+func newValueNetwork(t *testing.T, value []byte, holders ...uint8) (*fakeNetwork, *dht.RoutingTable) {
+	network := newFakeNetwork(t)
+	seeds := keyRange(0x80, 0x82)
+	for _, key := range keyRange(0x10, 0x1f) {
+		peer := &fakePeer{key: key}
+		if bytes.Contains(holders, []byte{key}) {
+			peer.value = value
+		}
+		network.start(peer)
+	}
+	for _, key := range seeds {
+		network.start(&fakePeer{key: key, closer: keyRange(0x10, 0x1f)})
+	}
+
+	rt, err := dht.New(selfKey, dht.Options{BucketSize: 4, CacheExpiryMinutes: 60, Domain: "127.0.0.1", Port: 1200})
+	if err != nil {
+		network.close()
+		t.Fatal(err)
+	}
+	network.seed(rt, seeds)
+	return network, rt
+}
+
+func TestFindValue(t *testing.T) {
+	value := []byte("value")
+
+	// the closest node has the value, the lookup stops at its reply
+	network, rt := newValueNetwork(t, value, 0x10)
+	found, nodes, ok := rt.FindValue(testKey(0))
+	if !ok || !bytes.Equal(found, value) {
+		t.Errorf("FindValue => %q, %v;want %q, true", found, ok, value)
+	}
+	if len(nodes) == 0 || nodes[0].Key[0] != 0x10 {
+		t.Errorf("FindValue => nodes %x;want the node with the value first", firstBytes(nodes))
+	}
+	if queried := network.queried(); bytes.Count(queried, []byte{0x10}) != 1 || bytes.Contains(queried, []byte{0x1f}) {
+		t.Errorf("FindValue queried %x;want 10 once and not 1f after the value was found", queried)
+	}
+	rt.Close()
+	network.close()
+
+	// nobody has the value, every node is queried and the k closest are returned
+	network, rt = newValueNetwork(t, value)
+	found, nodes, ok = rt.FindValue(testKey(0))
+	if ok || found != nil {
+		t.Errorf("FindValue => %q, %v;want nil, false", found, ok)
+	}
+	want := append(keyRange(0x10, 0x1f), 0x80, 0x81, 0x82)
+	if keys := firstBytes(nodes); !bytes.Equal(keys, want) {
+		t.Errorf("FindValue => nodes %x;want %x", keys, want)
+	}
+	if queried := network.queried(); len(queried) != len(want) {
+		t.Errorf("FindValue queried %x;want each of %x once", queried, want)
+	}
+	rt.Close()
+	network.close()
+}
+
+func TestStoreValue(t *testing.T) {
+	network := newFakeNetwork(t)
+	defer network.close()
+
+	// the seeds return 24 nodes of which 0x11 fails, so the k closest go upto 0x24
+	seeds := keyRange(0x80, 0x82)
+	near := keyRange(0x10, 0x27)
+	for _, key := range near {
+		network.start(&fakePeer{key: key, failing: key == 0x11})
+	}
+	for _, key := range seeds {
+		network.start(&fakePeer{key: key, closer: near})
+	}
+	rt, err := dht.New(selfKey, dht.Options{BucketSize: 4, CacheExpiryMinutes: 60, Domain: "127.0.0.1", Port: 1200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+	network.seed(rt, seeds)
+
+	key := testKey(0)
+	if stored := rt.StoreValue(key, []byte("value"), time.Hour); stored != constants.K_BUCKET_SIZE {
+		t.Errorf("StoreValue => stored on %d nodes;want %d", stored, constants.K_BUCKET_SIZE)
+	}
+
+	want := append([]uint8{0x10}, keyRange(0x12, 0x24)...)
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	for _, peerKey := range append(near, seeds...) {
+		stored := network.peers[peerKey].stored
+		if !bytes.Contains(want, []byte{peerKey}) {
+			if len(stored) != 0 {
+				t.Errorf("StoreValue stored on %x;want only on %x", peerKey, want)
+			}
+			continue
+		}
+		if len(stored) != 1 {
+			t.Errorf("StoreValue sent %x %d Store requests;want 1", peerKey, len(stored))
+			continue
+		}
+		request := stored[0]
+		if !bytes.Equal(request.Key, key[:]) || string(request.Value) != "value" || request.Ttl != 3600 {
+			t.Errorf("StoreValue sent %x key %x value %q ttl %d;want key %x value \"value\" ttl 3600", peerKey, request.Key, request.Value, request.Ttl, key)
+		}
+		if sender := request.Sender; sender == nil || !bytes.Equal(sender.NodeId, selfKey[:]) {
+			t.Errorf("StoreValue sent %x sender %v;want the node itself", peerKey, sender)
+		}
+	}
+}
+
+func TestPingSeen(t *testing.T) {
+	network := newFakeNetwork(t)
+	defer network.close()
+	for _, key := range keyRange(0x10, 0x12) {
+		network.start(&fakePeer{key: key})
+	}
+	rt, err := dht.New(selfKey, dht.Options{BucketSize: 2, CacheExpiryMinutes: 0, Backend: persistance.NewMemoryBackend(), SyncInterval: time.Hour, Domain: "127.0.0.1", Port: 1200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+	network.seed(rt, []uint8{0x10, 0x11})
+	before, _ := rt.PersistanceStats()
+
+	// the overflow ping moves the live head to the tail once, it isn't reported seen again
+	network.seed(rt, []uint8{0x12})
+	time.Sleep(50 * time.Millisecond)
+	if bucket := firstBytes(rt.Bucket(0)); !bytes.Equal(bucket, []byte{0x11, 0x10}) {
+		t.Errorf("Bucket after the row overflowed => %x;want 1110", bucket)
+	}
+	if stats, _ := rt.PersistanceStats(); stats.LogRecords != before.LogRecords+1 {
+		t.Errorf("LogRecords after the row overflowed => %d;want %d", stats.LogRecords, before.LogRecords+1)
+	}
+
+	// a node responding to a request is moved to the tail by the row listener
+	if livliness, err := rt.Ping(network.nodes[0x11]); err != nil || !livliness.Alive {
+		t.Fatalf("Ping => %v, %v;want alive", livliness, err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !bytes.Equal(firstBytes(rt.Bucket(0)), []byte{0x10, 0x11}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Bucket after Ping => %x;want 1011", firstBytes(rt.Bucket(0)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,64 @@
+package dht
+
+import (
+	"hydra-dht/constants"
+	structures "hydra-dht/structures"
+	"time"
+)
+
+// touchRow records that a lookup was made for a key in the row of target
+func (rt *RoutingTable) touchRow(target structures.NodeID) {
+	row := rt.GetRowNum(&structures.Node{Key: target})
+
+	rt.lock.Lock()
+	rt.lastLookup[row] = rt.now()
+	rt.lock.Unlock()
+}
+
+// idleRows returns the rows that have not seen a lookup within the refresh interval
+func (rt *RoutingTable) idleRows() []int {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	now := rt.now()
+	var rows []int
+	for row := 0; row < constants.HASH_SIZE; row++ {
+		if now.Sub(rt.lastLookup[row]) >= rt.refreshInterval {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+/*
+refreshBuckets runs in the background till the routing table is closed. Every row
+of the DHT that has not seen a lookup within the refresh interval is refreshed by
+looking up a random key in that row's range and adding the nodes found.
+*/
+func (rt *RoutingTable) refreshBuckets() {
+	defer rt.workers.Done()
+
+	checkEvery := rt.refreshInterval
+	if checkEvery > time.Minute {
+		checkEvery = time.Minute
+	}
+	ticker := time.NewTicker(checkEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-rt.quit:
+			return
+		}
+
+		for _, row := range rt.idleRows() {
+			select {
+			case <-rt.quit:
+				return
+			default:
+			}
+			rt.insertNodes(rt.Lookup(rt.randomIDInRow(row)))
+		}
+	}
+}
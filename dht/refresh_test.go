@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"fmt"
+	structures "hydra-dht/structures"
+	"testing"
+	"time"
+)
+
+func TestIdleRows(t *testing.T) {
+	clock := time.Unix(1500000000, 0)
+	rt := &RoutingTable{
+		self:            structures.Node{Key: structures.NodeID{0xa5, 4, 67, 124}},
+		refreshInterval: time.Hour,
+		now:             func() time.Time { return clock },
+	}
+	// no row has seen a lookup yet
+	for row := range rt.lastLookup {
+		rt.lastLookup[row] = clock.Add(-time.Hour)
+	}
+
+	var tests = []struct {
+		advance time.Duration
+		lookups []int
+		busy    []int
+	}{
+		{0, []int{5}, []int{5}},
+		{59 * time.Minute, []int{200}, []int{5, 200}},
+		// a row is idle once the refresh interval is up since its last lookup
+		{time.Minute, nil, []int{200}},
+		{50 * time.Minute, []int{0, 255}, []int{0, 200, 255}},
+		{10 * time.Minute, nil, []int{0, 255}},
+		// a lookup of a row again keeps it busy
+		{30 * time.Minute, []int{0}, []int{0, 255}},
+		{30 * time.Minute, nil, []int{0}},
+		{time.Hour, nil, nil},
+	}
+	for i, test := range tests {
+		clock = clock.Add(test.advance)
+		for _, row := range test.lookups {
+			rt.touchRow(rt.randomIDInRow(row))
+		}
+
+		idle := rt.idleRows()
+		isIdle := make(map[int]bool)
+		for _, row := range idle {
+			isIdle[row] = true
+		}
+		var busy []int
+		for row := range rt.lastLookup {
+			if !isIdle[row] {
+				busy = append(busy, row)
+			}
+		}
+		if fmt.Sprint(busy) != fmt.Sprint(test.busy) {
+			t.Errorf("step %d: idleRows => all rows but %v;want all but %v", i, busy, test.busy)
+		}
+	}
+}
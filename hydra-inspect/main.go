@@ -0,0 +1,303 @@
+/*
+hydra-inspect reads the persistance files of a Hydra node offline, for postmortems
+after crashes. The node must not be running on the data directory.
+
+Usage:
+
+	hydra-inspect [flags] log <log-N>            dump the records of a log file
+	hydra-inspect [flags] snapshot <dht-N>       print the bucket occupancy of a dht file
+	hydra-inspect [flags] replay <dht-N> <log-N> replay a log onto a dht file and print the table
+	hydra-inspect [flags] check                  validate every log and dht file
+	hydra-inspect [flags] export <dht-N> [log-N] print the table as JSON, after replaying the log if given
+
+The flags -data-dir, -storage and -key-file take the same values the node was run with.
+The files are only read, nothing is created in a data directory the node never wrote to.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hydra-dht/constants"
+	dhtUtil "hydra-dht/dht"
+	"hydra-dht/persistance"
+	pb "hydra-dht/protobuf/node"
+	"hydra-dht/structures"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	dataDir = flag.String("data-dir", "data", "The data directory of the node")
+	storage = flag.String("storage", "file", "The storage backend of the node, file or bolt")
+	keyFile = flag.String("key-file", "", "The key file the node encrypts its files with, if any")
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	backend, err := openBackend(*storage, *dataDir, *keyFile)
+	if err != nil {
+		fatal(err)
+	}
+	defer backend.Close()
+	store := persistance.NewStoreWithBackend(backend)
+
+	switch {
+	case args[0] == "log" && len(args) == 2:
+		err = dumpLog(store, args[1])
+	case args[0] == "snapshot" && len(args) == 2:
+		err = dumpSnapshot(store, args[1])
+	case args[0] == "replay" && len(args) == 3:
+		err = replay(store, args[1], args[2])
+	case args[0] == "check" && len(args) == 1:
+		err = check(store)
+	case args[0] == "export" && (len(args) == 2 || len(args) == 3):
+		err = export(store, args[1], args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		backend.Close()
+		fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  hydra-inspect [flags] log <log-N>\n")
+	fmt.Fprintf(os.Stderr, "  hydra-inspect [flags] snapshot <dht-N>\n")
+	fmt.Fprintf(os.Stderr, "  hydra-inspect [flags] replay <dht-N> <log-N>\n")
+	fmt.Fprintf(os.Stderr, "  hydra-inspect [flags] check\n")
+	fmt.Fprintf(os.Stderr, "  hydra-inspect [flags] export <dht-N> [log-N]\n")
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "hydra-inspect: %v\n", err)
+	os.Exit(1)
+}
+
+// openBackend opens the storage backend of kind in the data directory read only, encrypted
+// if a key file is given. It fails if the node never wrote to the data directory.
+func openBackend(kind string, dir string, keyFile string) (persistance.Backend, error) {
+	var keys *persistance.Keyring
+	if keyFile != "" {
+		var err error
+		keys, err = persistance.LoadKeyring(keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var backend persistance.Backend
+	var err error
+	switch kind {
+	case "file":
+		backend, err = persistance.OpenFileBackend(dir)
+	case "bolt":
+		backend, err = persistance.OpenBoltBackend(filepath.Join(dir, "hydra.db"))
+	default:
+		err = fmt.Errorf("unknown storage backend %q, use file or bolt", kind)
+	}
+	if err != nil || keys == nil {
+		return backend, err
+	}
+	return persistance.NewEncryptedBackend(backend, keys), nil
+}
+
+// dumpLog prints every record of the log file along with the checksum validation result
+func dumpLog(store *persistance.Store, name string) error {
+	file, err := store.Open(persistance.LOG, name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OFFSET\tBUCKET\tINDEX\tOP\tNODE\tADDRESS\tLAST SEEN\tDEAD")
+	records, size, invalid, err := persistance.ScanLog(file, func(offset int64, record *pb.LogNode) {
+		op := "add"
+		if record.GetRemoved() {
+			op = "remove"
+		} else if record.GetTouched() {
+			op = "touch"
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\t%s:%d\t%s\t%v\n",
+			offset, record.GetDhtIndex(), record.GetListIndex(), op,
+			nodeKey(record.GetNode()).Hex(), record.GetNode().GetDomain(), record.GetNode().GetPort(),
+			lastSeen(record.GetCache().GetLastSeen()), record.GetCache().GetDead())
+	})
+	w.Flush()
+
+	fmt.Printf("\n%s: %d bytes, %d valid records\n", name, size, records)
+	if err != nil {
+		fmt.Printf("%s: %d bytes after offset %d are invalid: %v\n", name, invalid, size-invalid, err)
+	}
+	return nil
+}
+
+// dumpSnapshot prints the number of nodes in every non empty bucket of the dht file
+func dumpSnapshot(store *persistance.Store, name string) error {
+	dht, cache, err := store.LoadDHTFile(name)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BUCKET\tNODES\tDEAD")
+	total := 0
+	for row := 0; row < constants.HASH_SIZE; row++ {
+		if len(dht.Lists[row]) == 0 {
+			continue
+		}
+		dead := 0
+		for _, c := range cache.Lists[row] {
+			if c.Dead {
+				dead++
+			}
+		}
+		total += len(dht.Lists[row])
+		fmt.Fprintf(w, "%d\t%d\t%d\n", row, len(dht.Lists[row]), dead)
+	}
+	w.Flush()
+
+	fmt.Printf("\n%s: %d nodes\n", name, total)
+	return nil
+}
+
+// replay applies the log file onto the dht file and prints the resulting table
+func replay(store *persistance.Store, dhtName string, logName string) error {
+	dht, cache, err := store.LoadDHTFile(dhtName)
+	if err != nil {
+		return err
+	}
+	file, err := store.Open(persistance.LOG, logName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	truncated, err := persistance.FlushLog(dht, cache, file)
+	if err != nil {
+		return err
+	}
+	printTable(dht, cache)
+	if truncated > 0 {
+		fmt.Printf("\n%s: discarded %d bytes of invalid records at the end\n", logName, truncated)
+	}
+	return nil
+}
+
+// export prints the dht file as JSON in the format of the routing table export, after
+// replaying the log files onto it
+func export(store *persistance.Store, dhtName string, logNames []string) error {
+	dht, cache, err := store.LoadDHTFile(dhtName)
+	if err != nil {
+		return err
+	}
+	for _, logName := range logNames {
+		file, err := store.Open(persistance.LOG, logName)
+		if err != nil {
+			return err
+		}
+		_, err = persistance.FlushLog(dht, cache, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	table := dhtUtil.ExportTable(structures.NodeID{}, dht, cache)
+	// the dht file alone doesn't tell which node it is of
+	table.NodeID = ""
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "    ")
+	return encoder.Encode(table)
+}
+
+// printTable prints every node of the dht along with its cache entry
+func printTable(dht *structures.DHT, cache *structures.Cache) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BUCKET\tINDEX\tNODE\tADDRESS\tLAST SEEN\tDEAD")
+	for row := 0; row < constants.HASH_SIZE; row++ {
+		for col, n := range dht.Lists[row] {
+			var c structures.CacheObject
+			if col < len(cache.Lists[row]) {
+				c = cache.Lists[row][col]
+			}
+			seen := "never"
+			if !c.LastTime.IsZero() {
+				seen = c.LastTime.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s:%d\t%s\t%v\n", row, col, n.Key.Hex(), n.Domain, n.Port, seen, c.Dead)
+		}
+	}
+	w.Flush()
+}
+
+// check validates every log and dht file of the data directory, it fails if any is invalid
+func check(store *persistance.Store) error {
+	invalid := 0
+	for _, f := range store.GetPersistanceFileNames(persistance.LOG) {
+		file, err := store.Open(persistance.LOG, f)
+		if err != nil {
+			fmt.Printf("%s: %v\n", f, err)
+			invalid++
+			continue
+		}
+		records, _, invalid, err := persistance.ScanLog(file, nil)
+		file.Close()
+		if err != nil {
+			fmt.Printf("%s: %d valid records, %d bytes invalid: %v\n", f, records, invalid, err)
+			invalid++
+			continue
+		}
+		fmt.Printf("%s: %d valid records\n", f, records)
+	}
+
+	for _, f := range store.GetPersistanceFileNames(persistance.DHT) {
+		dht, _, err := store.LoadDHTFile(f)
+		if err != nil {
+			fmt.Printf("%s: %v\n", f, err)
+			invalid++
+			continue
+		}
+		total := 0
+		for row := range dht.Lists {
+			total += len(dht.Lists[row])
+		}
+		fmt.Printf("%s: %d nodes\n", f, total)
+	}
+
+	if invalid > 0 {
+		return fmt.Errorf("%d invalid files", invalid)
+	}
+	return nil
+}
+
+// nodeKey returns the key of the protobuf node
+func nodeKey(n *pb.Node) structures.NodeID {
+	var key structures.NodeID
+	copy(key[:], n.GetNodeId())
+	return key
+}
+
+// lastSeen formats the last seen unix nanoseconds of a cache entry
+func lastSeen(nanos int64) string {
+	if nanos == 0 {
+		return "never"
+	}
+	return time.Unix(0, nanos).Format(time.RFC3339)
+}
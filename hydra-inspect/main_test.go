@@ -0,0 +1,79 @@
+package main
+
+import (
+	"hydra-dht/persistance"
+	"hydra-dht/structures"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newBackend opens the backend of kind in dir the way the node does
+func newBackend(kind string, dir string) (persistance.Backend, error) {
+	if kind == "bolt" {
+		return persistance.NewBoltBackend(filepath.Join(dir, "hydra.db"))
+	}
+	return persistance.NewFileBackend(dir)
+}
+
+func TestCheck(t *testing.T) {
+	root, err := ioutil.TempDir("", "hydra-inspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var tests = []struct {
+		kind    string
+		missing string
+	}{
+		// a data dir that doesn't exist isn't created
+		{"file", ""},
+		// a database that doesn't exist isn't created in the data dir
+		{"bolt", "hydra.db"},
+	}
+	for _, test := range tests {
+		dir := filepath.Join(root, test.kind)
+		if test.missing != "" {
+			os.MkdirAll(dir, 0755)
+		}
+		if _, err := openBackend(test.kind, dir, ""); err == nil {
+			t.Errorf("%s: openBackend of a missing data dir => nil;want an error", test.kind)
+		}
+		if _, err := os.Stat(filepath.Join(dir, test.missing)); !os.IsNotExist(err) {
+			t.Errorf("%s: openBackend of a missing data dir created %s", test.kind, filepath.Join(dir, test.missing))
+		}
+
+		// the files of a node are valid
+		backend, err := newBackend(test.kind, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := persistance.NewStoreWithBackend(backend)
+		store.InitPersistance()
+		store.AppendToLog(structures.Node{Key: structures.NodeID{1}, Domain: "127.0.0.1", Port: 10}, structures.CacheObject{}, 0, 0)
+		store.ClosePersistance()
+		backend.Close()
+
+		backend, err = openBackend(test.kind, dir, "")
+		if err != nil {
+			t.Fatalf("%s: openBackend => %v", test.kind, err)
+		}
+		if err := check(persistance.NewStoreWithBackend(backend)); err != nil {
+			t.Errorf("%s: check of valid files => %v", test.kind, err)
+		}
+		backend.Close()
+
+		// a corrupt dht file fails the check
+		backend, _ = newBackend(test.kind, dir)
+		backend.WriteSnapshot("dht-9", []byte("garbage"))
+		backend.Close()
+
+		backend, _ = openBackend(test.kind, dir, "")
+		if err := check(persistance.NewStoreWithBackend(backend)); err == nil {
+			t.Errorf("%s: check of a corrupt dht file => nil;want an error", test.kind)
+		}
+		backend.Close()
+	}
+}
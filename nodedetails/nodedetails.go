@@ -1,14 +1,114 @@
 package nodedetails
 
 import (
+	"crypto/rand"
 	constants "hydra-dht/constants"
 	structures "hydra-dht/structures"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
-//TODO Node id needs to be generated of current Node
+// MyNode is the current node. The values here are defaults for tests,
+// the server replaces them through InitMyNode on start up.
 var (
 	MyNode = &structures.Node{
 		Key:    [constants.NUM_BYTES]uint8{255, 4, 67, 24, 12, 34, 234, 24, 12, 34, 234, 24, 12, 34, 234, 24, 12, 34, 234, 24, 12, 34, 234, 24, 12, 34, 234, 24, 12, 34, 234, 24},
 		Domain: "127.0.0.1",
 		Port:   1200}
 )
+
+/*
+LoadOrCreateNodeID reads the node id saved in the file at path. If the file doesn't
+exist, a random 256 bit node id is generated and saved there so that the node keeps
+its identity across restarts. The id is stored hex encoded, the file is written
+atomically so a crash never leaves a node with a partly written id.
+
+Arguments:
+1. path: Path of the node id file
+Returns:
+1. NodeID: The node id
+2. error: nil if no error
+*/
+func LoadOrCreateNodeID(path string) (structures.NodeID, error) {
+	var key structures.NodeID
+
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		return structures.ParseNodeIDHex(strings.TrimSpace(string(content)))
+	}
+	if !os.IsNotExist(err) {
+		return key, err
+	}
+
+	if _, err = rand.Read(key[:]); err != nil {
+		return key, err
+	}
+	err = writeFileAtomic(path, []byte(key.Hex()+"\n"))
+	return key, err
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it and renames
+// it over path, so path has either none or all of data even after a crash
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	file, err := ioutil.TempFile(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir syncs the directory so that the files renamed into it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	closeErr := d.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+/*
+InitMyNode sets up the identity of the current node. The node id is loaded from
+the file at idPath, or generated on first start.
+
+Arguments:
+1. idPath: Path of the node id file
+2. domain: Domain other nodes reach this node at
+3. port: Port the server listens on
+Returns:
+1. error: nil if no error
+*/
+func InitMyNode(idPath string, domain string, port int) error {
+	key, err := LoadOrCreateNodeID(idPath)
+	if err != nil {
+		return err
+	}
+	MyNode.Key = key
+	MyNode.Domain = domain
+	MyNode.Port = port
+	return nil
+}
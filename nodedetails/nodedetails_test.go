@@ -0,0 +1,69 @@
+package nodedetails_test
+
+import (
+	"hydra-dht/nodedetails"
+	"hydra-dht/structures"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadOrCreateNodeID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydra-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node-id")
+
+	// the id is generated on first start and loaded on every start after
+	created, err := nodedetails.LoadOrCreateNodeID(path)
+	if err != nil || created == (structures.NodeID{}) {
+		t.Fatalf("LoadOrCreateNodeID of a missing file => %v, %v;want a random id", created, err)
+	}
+	content, _ := ioutil.ReadFile(path)
+	if strings.TrimSpace(string(content)) != created.Hex() {
+		t.Errorf("node id file => %q;want %s", content, created.Hex())
+	}
+	// the id is written through a temporary file that is renamed into place
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != "node-id" || files[0].Mode().Perm() != 0600 {
+		t.Errorf("files after LoadOrCreateNodeID => %v;want only node-id, readable by the owner only", files)
+	}
+	loaded, err := nodedetails.LoadOrCreateNodeID(path)
+	if err != nil || loaded != created {
+		t.Errorf("LoadOrCreateNodeID after restart => %v, %v;want %v", loaded, err, created)
+	}
+}
+
+func TestLoadMalformedNodeID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydra-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		name    string
+		content string
+	}{
+		{"empty", ""},
+		{"not hex", strings.Repeat("zz", 32)},
+		{"short", strings.Repeat("ab", 16)},
+		{"long", strings.Repeat("ab", 33)},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		ioutil.WriteFile(path, []byte(test.content), 0600)
+
+		// a malformed file is an error, the identity isn't silently replaced
+		if id, err := nodedetails.LoadOrCreateNodeID(path); err == nil {
+			t.Errorf("LoadOrCreateNodeID of %s file => %v;want an error", test.name, id)
+		}
+		if content, _ := ioutil.ReadFile(path); string(content) != test.content {
+			t.Errorf("%s file after LoadOrCreateNodeID => %q;want it untouched", test.name, content)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package persistance
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ReadSeekCloser is a log or dht file opened for reading
+type ReadSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// LogFile is a log of a backend that records are appended to. It can be read back
+// from while it is being appended to.
+type LogFile interface {
+	io.ReadSeeker
+	// Append writes the records at the end of the log and syncs them to stable storage
+	Append(records []byte) error
+	Close() error
+}
+
+/*
+Backend is the storage the logs and dht snapshots of a Store are kept in. Each
+generation of the DHT is a log file called log-N and the dht file called dht-N it
+is replayed onto, read documentation of RecoverDHT for more information.
+
+Backends are the file system, read NewFileBackend, memory for tests, read
+NewMemoryBackend, and an embedded key value store, read NewBoltBackend.
+*/
+type Backend interface {
+	// List returns the names of the files of fileType, in no particular order
+	List(fileType PERSISTANCE_FILE) ([]string, error)
+	// CreateLog creates the empty log file called name, replacing any of that name
+	CreateLog(name string) (LogFile, error)
+	// Open opens the file called name of fileType for reading
+	Open(fileType PERSISTANCE_FILE, name string) (ReadSeekCloser, error)
+	// WriteSnapshot writes data as the dht file called name. Either the old file
+	// or the complete new one is found after a crash.
+	WriteSnapshot(name string, data []byte) error
+	// Delete removes the file called name of fileType
+	Delete(fileType PERSISTANCE_FILE, name string) error
+	// Close releases the resources of the backend
+	Close() error
+}
+
+// fileBackend keeps the log files in the log folder and the dht files in the dht
+// folder of a data directory
+type fileBackend struct {
+	dir string
+}
+
+// fileLog is a log file of the file backend
+type fileLog struct {
+	*os.File
+}
+
+/*
+NewFileBackend creates a backend keeping its files in the data directory dir. The
+data directory along with its log and dht folders is created if it doesn't exist,
+so a fresh directory is set up on the first run. The temporary files of dht files
+a crash interrupted the writing of are removed.
+
+Arguments:
+1. dir: The data directory
+Returns:
+1. Backend: The backend
+2. error: Error in creating the directory layout or removing temporary files, nil if no error
+*/
+func NewFileBackend(dir string) (Backend, error) {
+	b := &fileBackend{dir: dir}
+	for _, fileType := range []PERSISTANCE_FILE{LOG, DHT} {
+		if err := os.MkdirAll(b.folder(fileType), 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.removeTempFiles(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+/*
+OpenFileBackend opens the backend of the existing data directory dir for reading the
+files of a node that isn't running, like hydra-inspect does. Unlike NewFileBackend
+nothing is created or removed, the backend must only be read from.
+
+Arguments:
+1. dir: The data directory
+Returns:
+1. Backend: The backend
+2. error: Error if the data directory doesn't exist, nil if no error
+*/
+func OpenFileBackend(dir string) (Backend, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: errors.New("not a directory")}
+	}
+	return &fileBackend{dir: dir}, nil
+}
+
+// removeTempFiles removes the temporary files WriteSnapshot leaves behind when it is interrupted
+func (b *fileBackend) removeTempFiles() error {
+	temps, err := filepath.Glob(filepath.Join(b.folder(DHT), "*.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, temp := range temps {
+		if err := os.Remove(temp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// folder returns the folder that files of fileType are kept in
+func (b *fileBackend) folder(fileType PERSISTANCE_FILE) string {
+	return filepath.Join(b.dir, string(fileType))
+}
+
+// path returns the path of the file called name of fileType
+func (b *fileBackend) path(fileType PERSISTANCE_FILE, name string) string {
+	return filepath.Join(b.folder(fileType), name)
+}
+
+// List returns the names of the files in the folder of fileType, a missing folder has no files
+func (b *fileBackend) List(fileType PERSISTANCE_FILE) ([]string, error) {
+	files, err := ioutil.ReadDir(b.folder(fileType))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names, err
+}
+
+// CreateLog creates the log file in the log folder, opened for appending
+func (b *fileBackend) CreateLog(name string) (LogFile, error) {
+	if err := os.MkdirAll(b.folder(LOG), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(b.path(LOG, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// the new log must persist along with the records synced to it
+	if err := syncDir(b.folder(LOG)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return fileLog{file}, nil
+}
+
+// Append writes the records in a single write followed by an fsync
+func (l fileLog) Append(records []byte) error {
+	_, err := l.Write(records)
+	if err != nil {
+		return err
+	}
+	return l.Sync()
+}
+
+// Open opens the file of fileType for reading
+func (b *fileBackend) Open(fileType PERSISTANCE_FILE, name string) (ReadSeekCloser, error) {
+	return os.Open(b.path(fileType, name))
+}
+
+/*
+WriteSnapshot saves the dht file atomically. The data is written to a temporary
+file which is synced and then renamed over the dht file, so a crash leaves either
+the old file or the complete new one. The directory is synced to persist the rename.
+*/
+func (b *fileBackend) WriteSnapshot(name string, data []byte) error {
+	if err := os.MkdirAll(b.folder(DHT), 0755); err != nil {
+		return err
+	}
+	path := b.path(DHT, name)
+	tempPath := path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return syncDir(b.folder(DHT))
+}
+
+// Delete removes the file of fileType
+func (b *fileBackend) Delete(fileType PERSISTANCE_FILE, name string) error {
+	return os.Remove(b.path(fileType, name))
+}
+
+// Close does nothing, the files are closed as they are done with
+func (b *fileBackend) Close() error {
+	return nil
+}
+
+// syncDir syncs the directory so that files created, renamed or removed in it persist
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	closeErr := d.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
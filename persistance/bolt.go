@@ -0,0 +1,261 @@
+package persistance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hydra-dht/constants"
+	"io"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrDatabaseLocked is returned when the bolt database is held open by another process
+var ErrDatabaseLocked = errors.New("database is locked by another process")
+
+// boltBackend keeps the files in a bolt database. Every log file is a bucket of
+// the log bucket holding its appends in order, every dht file a key of the dht bucket.
+type boltBackend struct {
+	db *bolt.DB
+}
+
+// boltLog is a log file of the bolt backend, it reads from its own position
+type boltLog struct {
+	backend  *boltBackend
+	name     string
+	position int64
+}
+
+/*
+NewBoltBackend creates a backend keeping its files in the embedded key value store
+at path, it is created if it doesn't exist. Every append and snapshot is a
+transaction of the store, so they are atomic and synced to disk once they return.
+
+Arguments:
+1. path: The path of the database file
+Returns:
+1. Backend: The backend, it must be closed with Close
+2. error: ErrDatabaseLocked if another process has the database open, else error in
+opening the database, nil if no error
+*/
+func NewBoltBackend(path string) (Backend, error) {
+	db, err := openBolt(path, &bolt.Options{Timeout: constants.BOLT_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, fileType := range []PERSISTANCE_FILE{LOG, DHT} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(fileType)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltBackend{db: db}, nil
+}
+
+/*
+OpenBoltBackend opens the existing embedded key value store at path read only, for
+reading the files of a node that isn't running, like hydra-inspect does. Unlike
+NewBoltBackend the database isn't created if it doesn't exist.
+
+Arguments:
+1. path: The path of the database file
+Returns:
+1. Backend: The backend, it must be closed with Close
+2. error: ErrDatabaseLocked if a running node has the database open, else error if
+the database doesn't exist or can't be opened, nil if no error
+*/
+func OpenBoltBackend(path string) (Backend, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := openBolt(path, &bolt.Options{ReadOnly: true, Timeout: constants.BOLT_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	return &boltBackend{db: db}, nil
+}
+
+// openBolt opens the bolt database at path, waiting upto the timeout of options for
+// another process to release its lock
+func openBolt(path string, options *bolt.Options) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, options)
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s: %w", path, ErrDatabaseLocked)
+	}
+	return db, err
+}
+
+// notExist is the error for a file missing from the bolt backend
+func notExist(op string, fileType PERSISTANCE_FILE, name string) error {
+	return &os.PathError{Op: op, Path: string(fileType) + "/" + name, Err: os.ErrNotExist}
+}
+
+// List returns the names of the files of fileType
+func (b *boltBackend) List(fileType PERSISTANCE_FILE) ([]string, error) {
+	var names []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		files := tx.Bucket([]byte(fileType))
+		if files == nil {
+			// a database opened read only may never have been written to
+			return nil
+		}
+		return files.ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// CreateLog creates the empty log file, replacing any of that name
+func (b *boltBackend) CreateLog(name string) (LogFile, error) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		logs := tx.Bucket([]byte(LOG))
+		if logs.Bucket([]byte(name)) != nil {
+			if err := logs.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		_, err := logs.CreateBucket([]byte(name))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltLog{backend: b, name: name}, nil
+}
+
+// readLog returns the appends of the log file in order
+func (b *boltBackend) readLog(name string) ([]byte, error) {
+	var data []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		log := tx.Bucket([]byte(LOG)).Bucket([]byte(name))
+		if log == nil {
+			return notExist("open", LOG, name)
+		}
+		return log.ForEach(func(k, v []byte) error {
+			data = append(data, v...)
+			return nil
+		})
+	})
+	return data, err
+}
+
+// Open opens a copy of the contents of the file of fileType for reading
+func (b *boltBackend) Open(fileType PERSISTANCE_FILE, name string) (ReadSeekCloser, error) {
+	if fileType == LOG {
+		data, err := b.readLog(name)
+		if err != nil {
+			return nil, err
+		}
+		return &memoryReader{bytes.NewReader(data)}, nil
+	}
+
+	var data []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(DHT)).Get([]byte(name))
+		if v == nil {
+			return notExist("open", DHT, name)
+		}
+		// values are only valid during the transaction
+		data = append([]byte{}, v...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &memoryReader{bytes.NewReader(data)}, nil
+}
+
+// WriteSnapshot writes the dht file in a single transaction
+func (b *boltBackend) WriteSnapshot(name string, data []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(DHT)).Put([]byte(name), data)
+	})
+}
+
+// Delete removes the file of fileType
+func (b *boltBackend) Delete(fileType PERSISTANCE_FILE, name string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		files := tx.Bucket([]byte(fileType))
+		if fileType == LOG {
+			if files.Bucket([]byte(name)) == nil {
+				return notExist("remove", fileType, name)
+			}
+			return files.DeleteBucket([]byte(name))
+		}
+		if files.Get([]byte(name)) == nil {
+			return notExist("remove", fileType, name)
+		}
+		return files.Delete([]byte(name))
+	})
+}
+
+// Close closes the database
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
+
+// Append adds the records as the next key of the log bucket in a single transaction
+func (l *boltLog) Append(records []byte) error {
+	return l.backend.db.Update(func(tx *bolt.Tx) error {
+		log := tx.Bucket([]byte(LOG)).Bucket([]byte(l.name))
+		if log == nil {
+			return notExist("append", LOG, l.name)
+		}
+		seq, err := log.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return log.Put(key, records)
+	})
+}
+
+// Read reads the log from the position of the bolt log. The log is read whole on
+// every call, the bolt log is only read back from when inspecting it.
+func (l *boltLog) Read(p []byte) (int, error) {
+	data, err := l.backend.readLog(l.name)
+	if err != nil {
+		return 0, err
+	}
+	if l.position >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[l.position:])
+	l.position += int64(n)
+	return n, nil
+}
+
+// Seek sets the position the bolt log is read from
+func (l *boltLog) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += l.position
+	case io.SeekEnd:
+		data, err := l.backend.readLog(l.name)
+		if err != nil {
+			return l.position, err
+		}
+		offset += int64(len(data))
+	}
+	if offset < 0 {
+		return l.position, errSeekOffset
+	}
+	l.position = offset
+	return offset, nil
+}
+
+// Close does nothing, the log stays in the database
+func (l *boltLog) Close() error {
+	return nil
+}
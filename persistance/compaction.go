@@ -0,0 +1,105 @@
+package persistance
+
+import (
+	"time"
+)
+
+// Stats are the statistics of the log and snapshots of a store
+type Stats struct {
+	// LogRecords and LogBytes are what was appended to the log since it was opened,
+	// which is what a recovery would replay. LogBytes are the bytes written to disk,
+	// which for an encrypted log are more than those of its records
+	LogRecords int
+	LogBytes   int64
+	// LastSnapshot is the time the last dht file was saved, zero if none was saved
+	// since the store was created
+	LastSnapshot time.Time
+}
+
+/*
+SetCompactionPolicy sets the size of the log at which the store asks for it to be
+compacted into a snapshot, read documentation of CompactionDue. The log is compacted
+when either limit is reached, a limit of 0 switches it off.
+
+Arguments:
+1. maxRecords: The max number of records in the log
+2. maxBytes: The max number of bytes in the log
+*/
+func (s *Store) SetCompactionPolicy(maxRecords int, maxBytes int64) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	s.maxLogRecords = maxRecords
+	s.maxLogBytes = maxBytes
+}
+
+/*
+CompactionDue receives once the log reaches the size set by SetCompactionPolicy. The
+owner of the DHT is expected to persist it with PersistDHT, which starts a new log.
+A receive can be stale if the DHT was persisted in between, so callers check Stats or
+NeedsCompaction before compacting.
+*/
+func (s *Store) CompactionDue() <-chan struct{} {
+	return s.compact
+}
+
+// NeedsCompaction returns true if the log has reached the size set by SetCompactionPolicy
+func (s *Store) NeedsCompaction() bool {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	return s.needsCompaction()
+}
+
+func (s *Store) needsCompaction() bool {
+	return (s.maxLogRecords > 0 && s.stats.LogRecords >= s.maxLogRecords) ||
+		(s.maxLogBytes > 0 && s.stats.LogBytes >= s.maxLogBytes)
+}
+
+// Stats returns the statistics of the log and snapshots of the store
+func (s *Store) Stats() Stats {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	return s.stats
+}
+
+// recordAppended counts a record appended to the log, and signals CompactionDue if the
+// log has grown past the compaction policy
+func (s *Store) recordAppended() {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	s.stats.LogRecords++
+	s.checkCompaction()
+}
+
+// logWritten counts size bytes written to the log on disk, and signals CompactionDue if
+// the log has grown past the compaction policy
+func (s *Store) logWritten(size int) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	s.stats.LogBytes += int64(size)
+	s.checkCompaction()
+}
+
+// checkCompaction signals CompactionDue if the log needs compaction, statsLock is held
+func (s *Store) checkCompaction() {
+	if s.needsCompaction() {
+		select {
+		case s.compact <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// logOpened resets the log statistics for a new empty log
+func (s *Store) logOpened() {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	s.stats.LogRecords = 0
+	s.stats.LogBytes = 0
+}
+
+// snapshotSaved records the time a dht file was saved
+func (s *Store) snapshotSaved() {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	s.stats.LastSnapshot = time.Now()
+}
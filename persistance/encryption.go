@@ -0,0 +1,559 @@
+package persistance
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hydra-dht/constants"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// encryptedSnapshotMagic starts every encrypted dht file
+var encryptedSnapshotMagic = []byte("HENC")
+
+var (
+	// ErrEncrypted is returned when an encrypted file is read without its key file
+	ErrEncrypted = errors.New("file is encrypted, the key file is needed to read it")
+	// ErrUnknownKey is returned when a file is encrypted with a key missing from the key file
+	ErrUnknownKey = errors.New("file is encrypted with a key missing from the key file")
+	// ErrDecrypt is returned when an encrypted frame fails authentication, the key
+	// of its id is wrong or the frame was tampered with
+	ErrDecrypt = errors.New("encrypted file failed authentication")
+
+	// errTornFrame is returned when an invalid encrypted frame runs to the end of the data
+	errTornFrame = errors.New("encrypted frame is torn")
+	// errCorruptFrame is returned when an invalid encrypted frame is followed by more data
+	errCorruptFrame = errors.New("encrypted frame is corrupt")
+)
+
+// FrameError is returned for a frame of an encrypted log that can't be opened. The
+// records of the log stop at the frame.
+type FrameError struct {
+	// Offset is where the frame starts in the log as written
+	Offset int64
+	// Size is the number of bytes of the log from the frame on
+	Size int64
+	// Torn is set if the frame runs to the end of the log, only the last frame can be torn by a crash
+	Torn bool
+}
+
+func (e *FrameError) Error() string {
+	if e.Torn {
+		return fmt.Sprintf("encrypted frame at byte %d is torn", e.Offset)
+	}
+	return fmt.Sprintf("encrypted frame at byte %d is corrupt", e.Offset)
+}
+
+// frameMap maps the decrypted records of an encrypted log back to the frames of the log
+// as written. A nil frameMap maps a log that isn't encrypted onto itself.
+type frameMap struct {
+	// offsets are where the frames start in the log, ends where their records end decrypted
+	offsets []int64
+	ends    []int64
+	// size is the size of the log as written
+	size int64
+	// tail is the frame the records stop at, nil if every frame was opened
+	tail *FrameError
+}
+
+// framedLog is implemented by the logs of the encrypted backend, which are read decrypted
+type framedLog interface {
+	frames() (*frameMap, error)
+}
+
+// framesOf returns the frame map of the log, nil if it isn't read decrypted
+func framesOf(log io.ReadSeeker) (*frameMap, error) {
+	if l, ok := log.(framedLog); ok {
+		return l.frames()
+	}
+	return nil, nil
+}
+
+// offset returns the offset in the log as written of position in the decrypted records,
+// which is the start of the frame they were sealed in
+func (m *frameMap) offset(position int64) int64 {
+	if m == nil {
+		return position
+	}
+	i := sort.Search(len(m.ends), func(i int) bool { return m.ends[i] > position })
+	if i < len(m.offsets) {
+		return m.offsets[i]
+	}
+	if m.tail != nil {
+		return m.tail.Offset
+	}
+	return m.size
+}
+
+// written returns the size of the log as written, given the size of its decrypted records
+func (m *frameMap) written(size int64) int64 {
+	if m == nil {
+		return size
+	}
+	return m.size
+}
+
+// sealed reports whether the records come out of frames, they can't be torn on their own then
+func (m *frameMap) sealed() bool {
+	return m != nil && len(m.offsets) > 0
+}
+
+// unopened returns the frame the records stop at, nil if there is none
+func (m *frameMap) unopened() *FrameError {
+	if m == nil {
+		return nil
+	}
+	return m.tail
+}
+
+// Keyring keeps the AES keys the persistance files are encrypted with by their id.
+// New files are encrypted with the active key, files of older generations are
+// decrypted with the key of the id in their header.
+type Keyring struct {
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+// NewKeyring creates an empty keyring, keys are added with AddKey
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[uint32]cipher.AEAD)}
+}
+
+/*
+AddKey adds the AES key with the id to the keyring, it becomes the active key. Keys
+must be added before the keyring is used.
+
+Arguments:
+1. id: The id of the key, written into the header of everything encrypted with it
+2. key: The AES key, 16, 24 or 32 bytes
+Returns:
+1. error: Error if the key is of a wrong size or the id is taken, nil if no error
+*/
+func (k *Keyring) AddKey(id uint32, key []byte) error {
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("key id %d is used twice", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.keys[id] = aead
+	k.active = id
+	return nil
+}
+
+/*
+LoadKeyring reads the keyring from the key file at path. Every line of the key file
+is a key id and a hex AES key separated by white space, blank lines and lines
+starting with # are skipped. The last key is the active one.
+
+Keys are rotated by appending a line with a new id. The old keys must be kept till
+every file encrypted with them is replaced, which happens on the next sync of the DHT.
+
+Arguments:
+1. path: The path of the key file
+Returns:
+1. *Keyring: The keyring
+2. error: Error in reading the key file or if it has no keys, nil if no error
+*/
+func LoadKeyring(path string) (*Keyring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	k := NewKeyring()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: wanted a key id and a hex key", path, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if err := k.AddKey(uint32(id), key); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return k, nil
+}
+
+/*
+seal encrypts data with the active key into a frame. The frame header is the
+encrypted record version, the key id, the size of the rest of the frame and its
+CRC32C checksum, like the header of a log record. The nonce and the sealed data
+follow, the version and key id are authenticated along with the data.
+*/
+func (k *Keyring) seal(data []byte) ([]byte, error) {
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, constants.LOG_ENCRYPTED_HEADER_BYTE_SIZE)
+	header[0] = constants.LOG_ENCRYPTED_RECORD_VERSION
+	binary.BigEndian.PutUint32(header[1:], k.active)
+	authenticated := header[:1+constants.LOG_KEY_ID_BYTE_SIZE]
+	body := aead.Seal(nonce, nonce, data, authenticated)
+
+	binary.PutUvarint(header[len(authenticated):], uint64(len(body)))
+	binary.LittleEndian.PutUint32(header[len(authenticated)+constants.LOG_OBJECT_BYTE_SIZE:], crc32.Checksum(body, crcTable))
+	return append(header, body...), nil
+}
+
+/*
+open decrypts the frame at the start of data.
+
+Returns:
+1. []byte: The decrypted data
+2. int: The size of the frame
+3. error: errTornFrame if the frame is torn, errCorruptFrame if it is invalid but
+followed by more data, ErrUnknownKey or ErrDecrypt if it can't be decrypted
+*/
+func (k *Keyring) open(data []byte) ([]byte, int, error) {
+	headerSize := constants.LOG_ENCRYPTED_HEADER_BYTE_SIZE
+	if len(data) < headerSize {
+		return nil, 0, errTornFrame
+	}
+	if data[0] != constants.LOG_ENCRYPTED_RECORD_VERSION {
+		return nil, 0, errCorruptFrame
+	}
+	authenticated := data[:1+constants.LOG_KEY_ID_BYTE_SIZE]
+	size, n := binary.Uvarint(data[len(authenticated) : len(authenticated)+constants.LOG_OBJECT_BYTE_SIZE])
+	if n <= 0 {
+		return nil, 0, errCorruptFrame
+	}
+	if size > uint64(len(data)-headerSize) {
+		return nil, 0, errTornFrame
+	}
+	body := data[headerSize : headerSize+int(size)]
+	checksum := binary.LittleEndian.Uint32(data[len(authenticated)+constants.LOG_OBJECT_BYTE_SIZE:])
+	if crc32.Checksum(body, crcTable) != checksum {
+		// only the last frame can be torn by a crash
+		if headerSize+int(size) == len(data) {
+			return nil, 0, errTornFrame
+		}
+		return nil, 0, errCorruptFrame
+	}
+
+	aead, ok := k.keys[binary.BigEndian.Uint32(data[1:])]
+	if !ok {
+		return nil, 0, ErrUnknownKey
+	}
+	if len(body) < aead.NonceSize() {
+		return nil, 0, errCorruptFrame
+	}
+	plain, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], authenticated)
+	if err != nil {
+		return nil, 0, ErrDecrypt
+	}
+	return plain, headerSize + int(size), nil
+}
+
+/*
+decryptLog decrypts the frames of an encrypted log. A log starting with a plain
+record was written before encryption was switched on and is returned as is.
+
+The records end at a frame that can't be opened for being torn or corrupt, it is
+kept in the frame map along with the offsets of the frames, so that replay reports
+the log as written.
+
+Returns:
+1. []byte: The decrypted records
+2. *frameMap: The frames of the log, nil if it isn't encrypted
+3. error: ErrUnknownKey or ErrDecrypt if a frame can't be decrypted, nil if no error
+*/
+func (k *Keyring) decryptLog(data []byte) ([]byte, *frameMap, error) {
+	if len(data) == 0 || data[0] == constants.LOG_RECORD_VERSION {
+		return data, nil, nil
+	}
+	m := &frameMap{}
+	plain, err := k.decryptFrames(nil, m, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plain, m, nil
+}
+
+// decryptFrames decrypts data, the frames of an encrypted log following the ones of m,
+// appending their records to plain and the frames to m
+func (k *Keyring) decryptFrames(plain []byte, m *frameMap, data []byte) ([]byte, error) {
+	start := m.size
+	m.size += int64(len(data))
+	for offset := 0; offset < len(data); {
+		records, n, err := k.open(data[offset:])
+		if err == errTornFrame || err == errCorruptFrame {
+			m.tail = &FrameError{Offset: start + int64(offset), Size: int64(len(data) - offset), Torn: err == errTornFrame}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		plain = append(plain, records...)
+		m.offsets = append(m.offsets, start+int64(offset))
+		m.ends = append(m.ends, int64(len(plain)))
+		offset += n
+	}
+	return plain, nil
+}
+
+// frameSize returns the size of the frame seal makes of size bytes of data
+func (k *Keyring) frameSize(size int) int {
+	aead := k.keys[k.active]
+	return constants.LOG_ENCRYPTED_HEADER_BYTE_SIZE + aead.NonceSize() + size + aead.Overhead()
+}
+
+// appendedSize returns the number of bytes appending size bytes of records writes to the log
+func appendedSize(log LogFile, size int) int {
+	if l, ok := log.(*encryptedLog); ok {
+		return l.keys.frameSize(size)
+	}
+	return size
+}
+
+// decryptSnapshot decrypts an encrypted dht file, dht files from before encryption was
+// switched on are returned as is
+func (k *Keyring) decryptSnapshot(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedSnapshotMagic) {
+		return data, nil
+	}
+	plain, _, err := k.open(data[len(encryptedSnapshotMagic):])
+	if err == errTornFrame || err == errCorruptFrame {
+		return nil, errors.New("encrypted dht file is corrupt")
+	}
+	return plain, err
+}
+
+// encryptedBackend encrypts the files of the backend it wraps
+type encryptedBackend struct {
+	backend Backend
+	keys    *Keyring
+}
+
+// encryptedLog is a log file of the encrypted backend. Every append is sealed into a
+// frame of its own. Reads decrypt the wrapped log, the records are cached once read so
+// that only the frames appended since are decrypted by the next read.
+type encryptedLog struct {
+	lock     sync.Mutex
+	log      LogFile
+	keys     *Keyring
+	position int64
+	plain    []byte
+	frameMap *frameMap
+}
+
+/*
+NewEncryptedBackend creates a backend encrypting the files of backend with AES-GCM.
+Every append to a log and every dht file is sealed with the active key of the
+keyring, files are decrypted with the key of the id in their header so files of
+older keys are still recovered. Files written before encryption was switched on
+are read as they are.
+
+Arguments:
+1. backend: The backend the encrypted files are kept in, it is closed along with the encrypted backend
+2. keys: The keyring
+Returns:
+1. Backend: The encrypted backend
+*/
+func NewEncryptedBackend(backend Backend, keys *Keyring) Backend {
+	return &encryptedBackend{backend: backend, keys: keys}
+}
+
+// List returns the names of the files of fileType
+func (b *encryptedBackend) List(fileType PERSISTANCE_FILE) ([]string, error) {
+	return b.backend.List(fileType)
+}
+
+// CreateLog creates the empty log file, replacing any of that name
+func (b *encryptedBackend) CreateLog(name string) (LogFile, error) {
+	log, err := b.backend.CreateLog(name)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedLog{log: log, keys: b.keys}, nil
+}
+
+// Open opens the decrypted contents of the file of fileType for reading
+func (b *encryptedBackend) Open(fileType PERSISTANCE_FILE, name string) (ReadSeekCloser, error) {
+	file, err := b.backend.Open(fileType, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if fileType == LOG {
+		plain, frames, err := b.keys.decryptLog(data)
+		if err != nil {
+			return nil, err
+		}
+		return &decryptedReader{memoryReader{bytes.NewReader(plain)}, frames}, nil
+	}
+	data, err = b.keys.decryptSnapshot(data)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryReader{bytes.NewReader(data)}, nil
+}
+
+// decryptedReader is a log of the encrypted backend opened for reading
+type decryptedReader struct {
+	memoryReader
+	frameMap *frameMap
+}
+
+// frames returns the frames the records of the log were decrypted from
+func (r *decryptedReader) frames() (*frameMap, error) {
+	return r.frameMap, nil
+}
+
+// WriteSnapshot writes the dht file sealed with the active key
+func (b *encryptedBackend) WriteSnapshot(name string, data []byte) error {
+	frame, err := b.keys.seal(data)
+	if err != nil {
+		return err
+	}
+	return b.backend.WriteSnapshot(name, append(append([]byte{}, encryptedSnapshotMagic...), frame...))
+}
+
+// Delete removes the file of fileType
+func (b *encryptedBackend) Delete(fileType PERSISTANCE_FILE, name string) error {
+	return b.backend.Delete(fileType, name)
+}
+
+// Close closes the wrapped backend
+func (b *encryptedBackend) Close() error {
+	return b.backend.Close()
+}
+
+// Append seals the records into a single frame and appends it to the log
+func (l *encryptedLog) Append(records []byte) error {
+	frame, err := l.keys.seal(records)
+	if err != nil {
+		return err
+	}
+	return l.log.Append(frame)
+}
+
+// decrypted returns the decrypted records of the wrapped log and its frames, decrypting
+// what was appended to the wrapped log since the last call
+func (l *encryptedLog) decrypted() ([]byte, *frameMap, error) {
+	size, err := l.log.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, nil, err
+	}
+	if l.frameMap == nil {
+		l.frameMap = &frameMap{}
+	}
+	if size == l.frameMap.size {
+		return l.plain, l.frameMap, nil
+	}
+
+	// a frame that couldn't be opened is read again along with what follows it
+	if tail := l.frameMap.tail; tail != nil {
+		l.frameMap.size = tail.Offset
+		l.frameMap.tail = nil
+	}
+	if _, err := l.log.Seek(l.frameMap.size, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(l.log)
+	if err == nil {
+		l.plain, err = l.keys.decryptFrames(l.plain, l.frameMap, data)
+	}
+	if err != nil {
+		l.plain, l.frameMap = nil, nil
+		return nil, nil, err
+	}
+	return l.plain, l.frameMap, nil
+}
+
+// frames returns the frames the records of the log are decrypted from
+func (l *encryptedLog) frames() (*frameMap, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, frames, err := l.decrypted()
+	return frames, err
+}
+
+// Read reads the decrypted records of the log from the position of the encrypted log
+func (l *encryptedLog) Read(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	plain, _, err := l.decrypted()
+	if err != nil {
+		return 0, err
+	}
+	if l.position >= int64(len(plain)) {
+		return 0, io.EOF
+	}
+	n := copy(p, plain[l.position:])
+	l.position += int64(n)
+	return n, nil
+}
+
+// Seek sets the position the encrypted log is read from, relative to its decrypted records
+func (l *encryptedLog) Seek(offset int64, whence int) (int64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += l.position
+	case io.SeekEnd:
+		plain, _, err := l.decrypted()
+		if err != nil {
+			return l.position, err
+		}
+		offset += int64(len(plain))
+	}
+	if offset < 0 {
+		return l.position, errSeekOffset
+	}
+	l.position = offset
+	return offset, nil
+}
+
+// Close closes the wrapped log
+func (l *encryptedLog) Close() error {
+	return l.log.Close()
+}
@@ -0,0 +1,161 @@
+package persistance
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// errSeekOffset is returned when seeking to before the start of a memory file
+var errSeekOffset = errors.New("seek to negative offset")
+
+// memoryBackend keeps the files in memory, it is meant for tests
+type memoryBackend struct {
+	lock  sync.Mutex
+	files map[PERSISTANCE_FILE]map[string]*memoryFile
+}
+
+// memoryFile is the contents of a file of the memory backend
+type memoryFile struct {
+	lock sync.Mutex
+	data []byte
+}
+
+// memoryLog is a log file of the memory backend, it reads from its own position
+type memoryLog struct {
+	file     *memoryFile
+	position int64
+}
+
+/*
+NewMemoryBackend creates a backend keeping its files in memory. Nothing survives the
+process, so it is meant for tests that mustn't touch the disk or each other's files.
+
+Returns:
+1. Backend: The backend
+*/
+func NewMemoryBackend() Backend {
+	return &memoryBackend{files: map[PERSISTANCE_FILE]map[string]*memoryFile{
+		LOG: make(map[string]*memoryFile),
+		DHT: make(map[string]*memoryFile),
+	}}
+}
+
+// List returns the names of the files of fileType
+func (b *memoryBackend) List(fileType PERSISTANCE_FILE) ([]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var names []string
+	for name := range b.files[fileType] {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// CreateLog creates the empty log file, replacing any of that name
+func (b *memoryBackend) CreateLog(name string) (LogFile, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	file := &memoryFile{}
+	b.files[LOG][name] = file
+	return &memoryLog{file: file}, nil
+}
+
+// Open opens a copy of the contents of the file of fileType for reading
+func (b *memoryBackend) Open(fileType PERSISTANCE_FILE, name string) (ReadSeekCloser, error) {
+	b.lock.Lock()
+	file, ok := b.files[fileType][name]
+	b.lock.Unlock()
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: string(fileType) + "/" + name, Err: os.ErrNotExist}
+	}
+
+	file.lock.Lock()
+	defer file.lock.Unlock()
+	return &memoryReader{bytes.NewReader(append([]byte{}, file.data...))}, nil
+}
+
+// WriteSnapshot replaces the dht file with data in a single step
+func (b *memoryBackend) WriteSnapshot(name string, data []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.files[DHT][name] = &memoryFile{data: append([]byte{}, data...)}
+	return nil
+}
+
+// Delete removes the file of fileType
+func (b *memoryBackend) Delete(fileType PERSISTANCE_FILE, name string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.files[fileType][name]; !ok {
+		return &os.PathError{Op: "remove", Path: string(fileType) + "/" + name, Err: os.ErrNotExist}
+	}
+	delete(b.files[fileType], name)
+	return nil
+}
+
+// Close does nothing, the files are dropped along with the backend
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+// memoryReader is a file of the memory backend opened for reading
+type memoryReader struct {
+	*bytes.Reader
+}
+
+// Close does nothing, the reader reads a copy of the file
+func (r *memoryReader) Close() error {
+	return nil
+}
+
+// Append adds the records at the end of the log
+func (l *memoryLog) Append(records []byte) error {
+	l.file.lock.Lock()
+	defer l.file.lock.Unlock()
+
+	l.file.data = append(l.file.data, records...)
+	return nil
+}
+
+// Read reads the log from the position of the memory log
+func (l *memoryLog) Read(p []byte) (int, error) {
+	l.file.lock.Lock()
+	defer l.file.lock.Unlock()
+
+	if l.position >= int64(len(l.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, l.file.data[l.position:])
+	l.position += int64(n)
+	return n, nil
+}
+
+// Seek sets the position the memory log is read from
+func (l *memoryLog) Seek(offset int64, whence int) (int64, error) {
+	l.file.lock.Lock()
+	defer l.file.lock.Unlock()
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += l.position
+	case io.SeekEnd:
+		offset += int64(len(l.file.data))
+	}
+	if offset < 0 {
+		return l.position, errSeekOffset
+	}
+	l.position = offset
+	return offset, nil
+}
+
+// Close does nothing, the log stays in the backend
+func (l *memoryLog) Close() error {
+	return nil
+}
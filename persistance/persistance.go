@@ -2,27 +2,23 @@ package persistance
 
 import (
 	"encoding/binary"
-	"encoding/gob"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"hydra-dht/constants"
 	pb "hydra-dht/protobuf/node"
 	"hydra-dht/structures"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 )
 
-var (
-	logFile      *os.File
-	filePosition int64
-	logIndex     int = 1
-)
-
 type PERSISTANCE_FILE string
 
 const (
@@ -30,10 +26,10 @@ const (
 	DHT PERSISTANCE_FILE = "dht"
 )
 
-// For sorting the log and dht files according to index that are read from the directory
+// For sorting the log and dht files according to index that are read from the backend
 type fileSortObject struct {
-	FileInfo os.FileInfo
-	Index    int64
+	Name  string
+	Index int64
 }
 
 // LogFileNameError is the struct to aid when there is
@@ -47,6 +43,20 @@ func (e *LogFileNameError) Error() string {
 	return fmt.Sprintf("Illegal LogFile name, the format for a log file is 'log-<int>', the file encountered is %s", e.fileName)
 }
 
+var (
+	// ErrTornRecord is returned when a log record is only partially written
+	ErrTornRecord = errors.New("log record is torn")
+	// ErrChecksumMismatch is returned when a log record fails its checksum
+	ErrChecksumMismatch = errors.New("log record checksum mismatch")
+	// ErrRecordVersion is returned when a log record has an unknown header version
+	ErrRecordVersion = errors.New("log record has unknown version")
+	// ErrCorruptRecord is returned when an invalid log record is followed by more of the log,
+	// so it can't have been torn by a crash in the middle of the last write
+	ErrCorruptRecord = errors.New("log record is corrupt")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
 /*
 convertNumberToBytes is a helper function to AppendToLog. It converts a uint64 number
 to a byte array . The size of byte array is 10. This is required to keep track of size of
@@ -71,25 +81,34 @@ func convertNumberToBytes(i uint64) ([]byte, int) {
 /*
 AppendToLog appends a DHT entry into the persistent transaction log.
 
-The function first adds the number of bytes the LogObject is of, then inserts
-the LogObject into the log file.
+The function first adds the record header, then inserts the LogObject into the
+log file. The LogObject carries the cache entry of the node, so that its liveness
+is restored along with it. The header is the record version byte, the number of bytes the
+LogObject is of and the CRC32C checksum of the LogObject.
 
 This method helps when we're reading the contents of the log back into memory.
 As the Log Object does not have a fixed size.
 
 Arguments:
 1. node :  Node object inside the DHT
-2. dhtIndex: Bucket Index of DHT table into which to put the node into
-3. listIndex: The index in the Bucket List of DHT in which the Node is added to.
+2. cache: The cache entry of the node
+3. dhtIndex: Bucket Index of DHT table into which to put the node into
+4. listIndex: The index in the Bucket List of DHT in which the Node is added to.
 
 Returns:
 1. error: Returns error , if no error then error is nil
 
 */
 
-func AppendToLogUtil(logFile *os.File, node structures.Node, dhtIndex int32, listIndex int32) error {
-	// write to file in following format
-	logObject := &pb.LogNode{
+func AppendToLogUtil(logFile LogFile, node structures.Node, cache structures.CacheObject, dhtIndex int32, listIndex int32) error {
+	logObject := newLogObject(node, dhtIndex, listIndex, false)
+	logObject.Cache = toCacheEntry(cache)
+	return appendLogObject(logFile, logObject)
+}
+
+// newLogObject wraps the node into the object stored in the log
+func newLogObject(node structures.Node, dhtIndex int32, listIndex int32, removed bool) *pb.LogNode {
+	return &pb.LogNode{
 		Node: &pb.Node{
 			NodeId: node.Key[:],
 			Domain: node.Domain,
@@ -97,39 +116,164 @@ func AppendToLogUtil(logFile *os.File, node structures.Node, dhtIndex int32, lis
 		},
 		DhtIndex:  dhtIndex,
 		ListIndex: listIndex,
+		Removed:   removed,
 	}
+}
 
-	out, err := proto.Marshal(logObject)
+// toCacheEntry converts a cache object to the cache entry stored in logs and dht files
+func toCacheEntry(c structures.CacheObject) *pb.CacheEntry {
+	entry := &pb.CacheEntry{Dead: c.Dead}
+	if !c.LastTime.IsZero() {
+		entry.LastSeen = c.LastTime.UnixNano()
+	}
+	return entry
+}
+
+// toCacheObject converts a stored cache entry back to a cache object. Missing entries,
+// as in files written before the cache was persisted, are treated as never seen.
+func toCacheObject(entry *pb.CacheEntry) structures.CacheObject {
+	c := structures.CacheObject{Dead: entry.GetDead()}
+	if entry.GetLastSeen() != 0 {
+		c.LastTime = time.Unix(0, entry.GetLastSeen())
+	}
+	return c
+}
 
+// appendLogObject writes the record header followed by the log object into the log file
+func appendLogObject(logFile LogFile, logObject *pb.LogNode) error {
+	ob, err := encodeLogRecord(logObject)
 	if err != nil {
 		return err
 	}
+
+	// writing the header and logObject into file in a single append
+	return logFile.Append(ob)
+}
+
+// encodeLogRecord encodes the log object into a log record, the record header followed by the log object
+func encodeLogRecord(logObject *pb.LogNode) ([]byte, error) {
+	// write to file in following format
+	out, err := proto.Marshal(logObject)
+
+	if err != nil {
+		return nil, err
+	}
 	// the number of bytes consisting of logObject
 	i := uint64(len(out))
 	buf, _ := convertNumberToBytes(i)
-	// writing the size of logObject into file
-	ob := append(buf, out...)
-	_, err = logFile.Write(ob)
+
+	header := make([]byte, constants.LOG_HEADER_BYTE_SIZE)
+	header[0] = constants.LOG_RECORD_VERSION
+	copy(header[1:], buf)
+	binary.LittleEndian.PutUint32(header[1+constants.LOG_OBJECT_BYTE_SIZE:], crc32.Checksum(out, crcTable))
+
+	return append(header, out...), nil
+}
+
+/*
+appendAsync queues the log object to be appended into the log of the store. Records
+appended concurrently share a single write and fsync, read documentation of logWriter
+for more information.
+
+Returns:
+1. <-chan error: Receives nil once the record is synced to disk, else the error
+*/
+func (s *Store) appendAsync(logObject *pb.LogNode) <-chan error {
+	flushed := make(chan error, 1)
+	if s.writer == nil {
+		flushed <- os.ErrInvalid
+		return flushed
+	}
+	record, err := encodeLogRecord(logObject)
 	if err != nil {
-		return err
+		flushed <- err
+		return flushed
 	}
+	s.recordAppended()
+	return s.writer.append(record)
+}
 
-	err = logFile.Sync()
+/*
+AppendToLogAsync queues a DHT entry to be appended into the log, without waiting
+for it to reach the disk. Records are written in the order they are queued, so a
+caller can queue while holding a lock and wait once it is released.
+Read Documentation for AppendToLogUtil for more information
 
-	return err
+Returns:
+1. <-chan error: Receives nil once the record is synced to disk, else the error
+*/
+func (s *Store) AppendToLogAsync(node structures.Node, cache structures.CacheObject, dhtIndex int32, listIndex int32) <-chan error {
+	logObject := newLogObject(node, dhtIndex, listIndex, false)
+	logObject.Cache = toCacheEntry(cache)
+	return s.appendAsync(logObject)
 }
 
 /*
 AppendToLog is the wrapper function called by the DHT to aappend an object into the log.
+It returns once the object is synced to disk.
 Read Documentation for AppendToLogUtil for more information
 */
-func AppendToLog(node structures.Node, dhtIndex int32, listIndex int32) error {
-	return AppendToLogUtil(logFile, node, dhtIndex, listIndex)
+func (s *Store) AppendToLog(node structures.Node, cache structures.CacheObject, dhtIndex int32, listIndex int32) error {
+	return <-s.AppendToLogAsync(node, cache, dhtIndex, listIndex)
+}
+
+// AppendToLog appends a DHT entry into the log of the default store
+func AppendToLog(node structures.Node, cache structures.CacheObject, dhtIndex int32, listIndex int32) error {
+	return defaultStore.AppendToLog(node, cache, dhtIndex, listIndex)
+}
+
+/*
+AppendRemovalToLogUtil appends a tombstone into the log, recording that the node was
+removed from the DHT. When the log is replayed the node is removed from its bucket.
+
+Arguments:
+1. logFile: The log file to append to
+2. node: The node removed from the DHT
+3. dhtIndex: Bucket Index of DHT table the node was removed from
+4. listIndex: The index in the Bucket List the node was at
+
+Returns:
+1. error: Returns error , if no error then error is nil
+*/
+func AppendRemovalToLogUtil(logFile LogFile, node structures.Node, dhtIndex int32, listIndex int32) error {
+	return appendLogObject(logFile, newLogObject(node, dhtIndex, listIndex, true))
+}
+
+/*
+AppendRemovalToLog is the wrapper function called by the DHT to append a tombstone into the log.
+Read Documentation for AppendRemovalToLogUtil for more information
+*/
+func (s *Store) AppendRemovalToLog(node structures.Node, dhtIndex int32, listIndex int32) error {
+	return <-s.AppendRemovalToLogAsync(node, dhtIndex, listIndex)
+}
+
+// AppendRemovalToLogAsync queues a tombstone to be appended into the log, read documentation of AppendToLogAsync
+func (s *Store) AppendRemovalToLogAsync(node structures.Node, dhtIndex int32, listIndex int32) <-chan error {
+	return s.appendAsync(newLogObject(node, dhtIndex, listIndex, true))
+}
+
+/*
+AppendTouchToLogAsync queues a touch record to be appended into the log, recording that
+the node was seen and moved from listIndex to the tail of its bucket with the cache entry.
+When the log is replayed the node is moved the same way, read documentation of
+AppendToLogAsync.
+*/
+func (s *Store) AppendTouchToLogAsync(node structures.Node, cache structures.CacheObject, dhtIndex int32, listIndex int32) <-chan error {
+	logObject := newLogObject(node, dhtIndex, listIndex, false)
+	logObject.Cache = toCacheEntry(cache)
+	logObject.Touched = true
+	return s.appendAsync(logObject)
+}
+
+// AppendRemovalToLog appends a tombstone into the log of the default store
+func AppendRemovalToLog(node structures.Node, dhtIndex int32, listIndex int32) error {
+	return defaultStore.AppendRemovalToLog(node, dhtIndex, listIndex)
 }
 
 /*
 ReadObjectFromLog reads and sends the latest / last log Object inside
-the log file.
+the log file. The record header is verified and the pointer is only moved
+past the record if it is valid.
 
 Arguments:
 1. Log: the log file in which to read an object from
@@ -137,43 +281,73 @@ Arguments:
 Returns:
 1. logNode = The Log node object retrieved from the log file. It will be empty
 if there is an error
-2. error = Error object. Will be nil if no error.
+2. error = Error object. Will be nil if no error. ErrTornRecord if the record is
+only partially written, ErrChecksumMismatch or ErrRecordVersion if it is corrupt.
+ErrEncrypted if the log is encrypted, read documentation of NewEncryptedBackend.
 
 */
-func ReadObjectFromLog(log *os.File, logPosition *int64) (*pb.LogNode, error) {
+func ReadObjectFromLog(log io.ReadSeeker, logPosition *int64) (*pb.LogNode, error) {
 
-	log.Seek(*logPosition, 0)
+	_, err := log.Seek(*logPosition, 0)
+	if err != nil {
+		return &pb.LogNode{}, err
+	}
 
-	sizeOfLogObjectBuffer := make([]byte, constants.LOG_OBJECT_BYTE_SIZE)
-	log.Read(sizeOfLogObjectBuffer)
-	*logPosition += constants.LOG_OBJECT_BYTE_SIZE
+	header := make([]byte, constants.LOG_HEADER_BYTE_SIZE)
+	n, err := io.ReadFull(log, header)
+	if n > 0 && header[0] == constants.LOG_ENCRYPTED_RECORD_VERSION {
+		return &pb.LogNode{}, ErrEncrypted
+	}
+	if err != nil {
+		return &pb.LogNode{}, ErrTornRecord
+	}
+	if header[0] != constants.LOG_RECORD_VERSION {
+		return &pb.LogNode{}, ErrRecordVersion
+	}
 
-	sizeOfLogObject, _ := binary.Uvarint(sizeOfLogObjectBuffer)
-	*logPosition += int64(sizeOfLogObject)
+	sizeOfLogObject, n := binary.Uvarint(header[1 : 1+constants.LOG_OBJECT_BYTE_SIZE])
+	if n <= 0 || sizeOfLogObject > constants.MAX_LOG_OBJECT_SIZE {
+		return &pb.LogNode{}, ErrTornRecord
+	}
+	checksum := binary.LittleEndian.Uint32(header[1+constants.LOG_OBJECT_BYTE_SIZE:])
 
 	logObjectBuffer := make([]byte, sizeOfLogObject)
-	log.Read(logObjectBuffer)
+	if _, err = io.ReadFull(log, logObjectBuffer); err != nil {
+		return &pb.LogNode{}, ErrTornRecord
+	}
+	if crc32.Checksum(logObjectBuffer, crcTable) != checksum {
+		return &pb.LogNode{}, ErrChecksumMismatch
+	}
 
 	logObject := &pb.LogNode{}
-	err := proto.Unmarshal(logObjectBuffer, logObject)
+	err = proto.Unmarshal(logObjectBuffer, logObject)
+	if err != nil {
+		return logObject, err
+	}
 
-	return logObject, err
+	*logPosition += constants.LOG_HEADER_BYTE_SIZE + int64(sizeOfLogObject)
+	return logObject, nil
 }
 
 /*
 addToDHT is a helper function to the LoadDHT function. It adds the value to the
-DHT. If required it appends the value to list, else it inserts the value at the
-said position.
+DHT and its cache entry to the cache. If required it appends the value to list,
+else it inserts the value at the said position. The lists of the DHT and cache
+are always changed together, so they never go out of sync.
 
 Arguments:
 1. dht - The DHT in which value is added
-2. logObject - The object which contains value to be added, along with dhtIndex
+2. cache - The cache of the DHT
+3. logObject - The object which contains value to be added, along with dhtIndex
 (the bucket in which the value is to be inserted) and bucket list index in
  which the value is to inserted.
 
+A tombstone log object removes the node with the same key from the bucket instead,
+and a touch log object moves it to the tail of the bucket.
+
 Please check proto Log Object defination to know more about the LogNode variable.
 */
-func addToDHT(dht *structures.DHT, logObject *pb.LogNode) {
+func addToDHT(dht *structures.DHT, cache *structures.Cache, logObject *pb.LogNode) {
 	row := logObject.DhtIndex
 	col := logObject.ListIndex
 
@@ -181,94 +355,242 @@ func addToDHT(dht *structures.DHT, logObject *pb.LogNode) {
 
 	copy(nodeID[:], logObject.Node.NodeId)
 
+	if logObject.Removed || logObject.Touched {
+		for i := range dht.Lists[row] {
+			if dht.Lists[row][i].Key == nodeID {
+				dht.Lists[row] = append(dht.Lists[row][:i:i], dht.Lists[row][i+1:]...)
+				cache.Lists[row] = append(cache.Lists[row][:i:i], cache.Lists[row][i+1:]...)
+				break
+			}
+		}
+		if logObject.Removed {
+			return
+		}
+	}
+
 	n := &structures.Node{
 		Key:    nodeID,
 		Port:   int(logObject.Node.Port),
 		Domain: logObject.Node.Domain,
 	}
 
+	c := toCacheObject(logObject.Cache)
+
+	if logObject.Touched {
+		dht.Lists[row] = append(dht.Lists[row], *n)
+		cache.Lists[row] = append(cache.Lists[row], c)
+		return
+	}
+
 	if len(dht.Lists[row]) < int(col+1) {
 		dht.Lists[row] = append(dht.Lists[row], *n)
+		cache.Lists[row] = append(cache.Lists[row], c)
 	} else {
 		dht.Lists[row][col] = *n
+		cache.Lists[row][col] = c
 	}
 }
 
 /*
-FlushLog reads the log's objects and applies it to the dht in the argument.
+FlushLog reads the log's objects and applies it to the dht and cache in the argument.
+
+If the tail of the log is torn, for example by a power loss in the middle of a
+write, replay stops cleanly at the last valid record and the rest of the log
+is discarded. An invalid record that doesn't run to the end of the log wasn't
+torn by a crash, replay stops there as well but returns ErrCorruptRecord.
 
 Arguments:
 1. dht: The pointer to the DHT on which the operations of log are applied.
-2. log: The log file which has the operations stored.
+2. cache: The pointer to the cache of the DHT, kept in sync with it.
+3. log: The log file which has the operations stored.
 Returns:
-1. error: Error if any, nil if no error
+1. int64: The number of bytes discarded after the last valid record, 0 if none
+2. error: Error if any, nil if no error. ErrCorruptRecord if the log is corrupt before its end
 
-The DHT is modified and since it's passed by reference, there is no need to return it.
+The DHT and cache are modified and since they're passed by reference, there is no need to return them.
 */
-func FlushLog(dht *structures.DHT, log *os.File) error {
-	fi, err := log.Stat()
+func FlushLog(dht *structures.DHT, cache *structures.Cache, log io.ReadSeeker) (int64, error) {
+	_, truncated, err := replayLog(dht, cache, log)
+	return truncated, err
+}
+
+// replayLog applies the log like FlushLog, it also returns the number of records applied
+func replayLog(dht *structures.DHT, cache *structures.Cache, log io.ReadSeeker) (int, int64, error) {
+	frames, err := framesOf(log)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := log.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
 	var logPosition int64
 	logPosition = 0
+	records := 0
 	for {
-		if logPosition >= fi.Size() {
+		if logPosition >= size {
 			break
 		}
+		recordPosition := logPosition
 		logObject, err := ReadObjectFromLog(log, &logPosition)
+		if err == ErrEncrypted {
+			// the records aren't torn, they can't be read without the key
+			return records, 0, err
+		}
+		if err == nil && !isValidLogObject(logObject) {
+			return records, 0, fmt.Errorf("%v: invalid record at byte %d", ErrCorruptRecord, frames.offset(recordPosition))
+		}
 		if err != nil {
-			return err
+			// the records of a frame that was opened are whole
+			if frames.sealed() || !recordReachesEnd(log, recordPosition, size) {
+				return records, 0, fmt.Errorf("%v: %v at byte %d", ErrCorruptRecord, err, frames.offset(recordPosition))
+			}
+			return records, size - recordPosition, nil
 		}
 
-		addToDHT(dht, logObject)
+		addToDHT(dht, cache, logObject)
+		records++
 	}
 
-	return err
+	// the records of an encrypted log stop at a frame that can't be opened
+	if tail := frames.unopened(); tail != nil {
+		if tail.Torn {
+			return records, tail.Size, nil
+		}
+		return records, 0, fmt.Errorf("%v: %v", ErrCorruptRecord, tail)
+	}
+	return records, 0, nil
+}
+
+/*
+ScanLog reads the records of the log one by one, verifying their checksums, and calls
+f with every valid record. It stops at the first record that fails to read.
+
+Offsets are those of the log as written. The logs of the encrypted backend are read
+decrypted, the offset of their records is that of the frame they were sealed in.
+
+Arguments:
+1. log: The log file
+2. f: Called with the offset of every valid record, may be nil
+Returns:
+1. int: The number of valid records
+2. int64: The size of the log as written
+3. int64: The number of bytes from the first invalid record on, 0 if none
+4. error: The reason reading stopped early, a *FrameError for a frame that can't be
+opened, nil if the whole log is valid
+*/
+func ScanLog(log io.ReadSeeker, f func(offset int64, record *pb.LogNode)) (int, int64, int64, error) {
+	frames, err := framesOf(log)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	size, err := log.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	written := frames.written(size)
+
+	var position int64
+	records := 0
+	for position < size {
+		offset := position
+		record, err := ReadObjectFromLog(log, &position)
+		if err != nil {
+			return records, written, written - frames.offset(offset), err
+		}
+		records++
+		if f != nil {
+			f(frames.offset(offset), record)
+		}
+	}
+	if tail := frames.unopened(); tail != nil {
+		return records, written, tail.Size, tail
+	}
+	return records, written, 0, nil
+}
+
+// recordReachesEnd checks if the record at position runs to the end of the log, as only
+// the last record can be torn by a crash. A header cut short always does.
+func recordReachesEnd(log io.ReadSeeker, position int64, size int64) bool {
+	header := make([]byte, constants.LOG_HEADER_BYTE_SIZE)
+	if _, err := log.Seek(position, io.SeekStart); err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(log, header); err != nil {
+		return true
+	}
+	sizeOfLogObject, n := binary.Uvarint(header[1 : 1+constants.LOG_OBJECT_BYTE_SIZE])
+	if n <= 0 {
+		return false
+	}
+	return sizeOfLogObject >= uint64(size-position-constants.LOG_HEADER_BYTE_SIZE)
+}
+
+// isValidLogObject checks that the log object can be applied to a DHT
+func isValidLogObject(logObject *pb.LogNode) bool {
+	return logObject.Node != nil &&
+		logObject.DhtIndex >= 0 && logObject.DhtIndex < constants.HASH_SIZE &&
+		logObject.ListIndex >= 0
 }
 
 // persists dht at regular time intervas when called from dht.go
-func PersistDHT(dht structures.DHT) error {
+func (s *Store) PersistDHT(dht structures.DHT, cache structures.Cache) error {
 
-	logIndex++
-	OpenLogFile("log-" + strconv.Itoa(logIndex)) // sets up new log file
-	err := flushDataStructureToDisk(&dht)
+	s.stopWriter()
+	if s.logFile != nil {
+		s.logFile.Close()
+	}
+	s.logIndex++
+	_, _, err := s.OpenLogFile("log-" + strconv.Itoa(s.logIndex)) // sets up new log file
+	if err != nil {
+		return err
+	}
+	// old logs and dhts are only cleared once the new dht is safely on disk
+	err = s.flushDataStructureToDisk(&dht, &cache)
 
 	if err != nil {
 		return err
 	}
-	logFilename := "log-" + strconv.Itoa(logIndex)
-	dhtFilename := "dht-" + strconv.Itoa(logIndex-1)
-	clearAllLogsAndDhtsBut(logFilename, dhtFilename)
+	logFilename := "log-" + strconv.Itoa(s.logIndex)
+	dhtFilename := "dht-" + strconv.Itoa(s.logIndex-1)
+	s.clearAllLogsAndDhtsBut(logFilename, dhtFilename)
 
 	return nil
 }
 
+// PersistDHT persists the dht in the default store
+func PersistDHT(dht structures.DHT, cache structures.Cache) error {
+	return defaultStore.PersistDHT(dht, cache)
+}
+
 // remove old log file,
 // remove all log files not of the following name
 // clear log till some point
-func clearAllLogsAndDhtsBut(logFilename string, dhtFilename string) {
+func (s *Store) clearAllLogsAndDhtsBut(logFilename string, dhtFilename string) {
 
-	logFiles := GetPersistanceFileNames(LOG)
-	dhtFiles := GetPersistanceFileNames(DHT)
+	logFiles := s.GetPersistanceFileNames(LOG)
+	dhtFiles := s.GetPersistanceFileNames(DHT)
 
-	// crucial operation, if shut down occurs now
-	// information is lost.
+	// the latest dht is synced to disk by now, so
+	// a shut down here leaves extra files at worst.
 
 	for _, l := range logFiles {
-		if logFilename != l.Name() {
-			os.Remove("log/" + l.Name())
+		if logFilename != l {
+			s.backend.Delete(LOG, l)
 		}
 	}
 	for _, d := range dhtFiles {
-		if dhtFilename != d.Name() {
-			os.Remove("dht/" + d.Name())
+		if dhtFilename != d {
+			s.backend.Delete(DHT, d)
 		}
 	}
 }
 
 // Saves the dht to Disk
-func flushDataStructureToDisk(dht *structures.DHT) error {
+func (s *Store) flushDataStructureToDisk(dht *structures.DHT, cache *structures.Cache) error {
 	//  todo
-	filename := "dht/dht-" + strconv.Itoa(logIndex-1) // save dht of old log.
-	err := SaveDHT(filename, dht)
+	filename := "dht-" + strconv.Itoa(s.logIndex-1) // save dht of old log.
+	err := s.SaveDHT(filename, dht, cache)
 
 	return err
 }
@@ -295,40 +617,44 @@ We look at DHT saved
 5. all good
 
 Arguments:
-1. filename = Name of the log file
+1. fileType = Whether to list the log or the dht files
 Returns:
-1. error = nil if no error else error
+1. []string = The file names, latest first. Files not named <fileType>-<int> are skipped.
 */
-func GetPersistanceFileNames(fileType PERSISTANCE_FILE) []os.FileInfo {
-	files, err := ioutil.ReadDir(string(fileType))
+func (s *Store) GetPersistanceFileNames(fileType PERSISTANCE_FILE) []string {
+	files, err := s.backend.List(fileType)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println(err)
 	}
 
 	var latestLogs []fileSortObject
 	for i := len(files) - 1; i >= 0; i-- {
-		fileName := files[i].Name()
+		fileName := files[i]
 		j, err := GetFileIndex(fileName, fileType)
 		if err != nil {
-			// just print the error or not
-			fmt.Println(err)
-		} else {
-			latestLogs = append(latestLogs, fileSortObject{FileInfo: files[i], Index: j})
+			// not a file of the store, like the temporary file of a dht file being written
+			continue
 		}
+		latestLogs = append(latestLogs, fileSortObject{Name: fileName, Index: j})
 	}
 
 	sort.Slice(latestLogs, func(i, j int) bool {
 		return latestLogs[i].Index > latestLogs[j].Index
 	})
 
-	var finalLogs []os.FileInfo
+	var finalLogs []string
 	for _, f := range latestLogs {
-		finalLogs = append(finalLogs, f.FileInfo)
+		finalLogs = append(finalLogs, f.Name)
 	}
 
 	return finalLogs
 }
 
+// GetPersistanceFileNames gets the files of fileType in the default store, latest first
+func GetPersistanceFileNames(fileType PERSISTANCE_FILE) []string {
+	return defaultStore.GetPersistanceFileNames(fileType)
+}
+
 /*
 GetFileIndex gets the index of file in the log or dht folders.
 For examples if the filename is log-23, it will return 23.
@@ -352,14 +678,26 @@ func GetFileIndex(name string, fileType PERSISTANCE_FILE) (int64, error) {
 
 // will always create new log file after recover
 // saves dht object and then clears up log.
-func OpenLogFile(filename string) (*os.File, *int64, error) {
+func (s *Store) OpenLogFile(filename string) (LogFile, *int64, error) {
+
+	// the records queued for the previous log file are written to it first
+	s.stopWriter()
 
 	// create file
 	var err error
-	logFile, err = os.Create("log/" + filename)
-	filePosition = 0
+	s.logFile, err = s.backend.CreateLog(filename)
+	s.filePosition = 0
+	if err == nil {
+		s.writer = newLogWriter(s.logFile, s.commitLatency, s.logWritten)
+		s.logOpened()
+	}
+
+	return s.logFile, &s.filePosition, err
+}
 
-	return logFile, &filePosition, err
+// OpenLogFile creates the log file in the default store
+func OpenLogFile(filename string) (LogFile, *int64, error) {
+	return defaultStore.OpenLogFile(filename)
 }
 
 /*
@@ -371,19 +709,31 @@ Arguments:
 None
 Returns:
 1. The persistant Dht retrieved by starting up the program.nil if error
-2. error = nil if no error else error
+2. The cache of the Dht, its lists are of the same length as the Dht's
+3. The log file
+4. The position in the log file
+5. error = nil if no error else error, a *RecoveryError if a strict recovery
+refused to discard files. Read LastRecovery for the report of the recovery.
 */
-func InitPersistance() (*structures.DHT, *os.File, *int64, error) {
+func (s *Store) InitPersistance() (*structures.DHT, *structures.Cache, LogFile, *int64, error) {
 	//  setup periodic flushing to disk
 	// open file
-	var err error
-	dht, filename := RecoverDHT()
-	logIndex = 1
-	_, _, err = OpenLogFile(filename)
+	dht, cache, filename, report, err := s.RecoverDHT()
+	s.recovery = report
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	s.logIndex = 1
+	_, _, err = s.OpenLogFile(filename)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
-	return dht, logFile, &filePosition, nil
+	return dht, cache, s.logFile, &s.filePosition, nil
+}
+
+// InitPersistance starts the persistance module on the default store
+func InitPersistance() (*structures.DHT, *structures.Cache, LogFile, *int64, error) {
+	return defaultStore.InitPersistance()
 }
 
 /* persistanceCleanUp cleans up all logs and dhts and saves new fresh dht sent through
@@ -391,43 +741,69 @@ the arguments.
 Arguments:
 
 1. dht = The DHT to be saved.structures
+2. cache = The cache of the DHT
+
+Rest every log and dht is deleted. Nothing is deleted if the dht can't be saved.
 
-Rest every log and dht is deleted.
+Returns:
+1. string: The name of the new log file
+2. error: Error in saving the dht, nil if no error
 */
-func persistanceCleanUp(dht *structures.DHT) string {
+func (s *Store) persistanceCleanUp(dht *structures.DHT, cache *structures.Cache) (string, error) {
 
-	logFiles := GetPersistanceFileNames(LOG)
-	dhtFiles := GetPersistanceFileNames(DHT)
+	logFiles := s.GetPersistanceFileNames(LOG)
+	dhtFiles := s.GetPersistanceFileNames(DHT)
+
+	// save dht to disk, the logs and dhts are only removed once it is there
+	err := s.SaveDHT("dht-0", dht, cache)
+	if err != nil {
+		return "", err
+	}
 
-	// crucial operation, if shut down occurs now
-	// information is lost.
 	for _, d := range dhtFiles {
-		os.Remove("dht/" + d.Name())
+		if d != "dht-0" {
+			s.backend.Delete(DHT, d)
+		}
 	}
 
 	for _, l := range logFiles {
-		os.Remove("log/" + l.Name())
+		s.backend.Delete(LOG, l)
 	}
 
-	// save dht to disk
-	SaveDHT("dht/dht-0", dht)
-
 	// the index of the new log file
-	return "log-1"
+	return "log-1", nil
 }
 
-// recovers dht if sudden shut down, this culd be multiple log files and dhts in folder.
-// It cleans up the folders and saves new fresh dht in disk and starts new log.
-func RecoverDHT() (*structures.DHT, string) {
-	logFiles := GetPersistanceFileNames(LOG)
-	dhtFiles := GetPersistanceFileNames(DHT)
+/*
+RecoverDHT recovers the dht if sudden shut down, this could be multiple log files and dhts
+in the backend. The latest readable dht is loaded and the logs following it are replayed
+onto it, read documentation of GetPersistanceFileNames for the failure scenarios.
+It cleans up the files and saves new fresh dht and starts new log.
+
+In strict mode nothing is cleaned up and a RecoveryError is returned if any file would be
+discarded, read documentation of SetStrictRecovery.
+Strict or not, nothing is cleaned up and a *KeyError is returned if a file can't be read
+with the keys of the backend, read documentation of NewEncryptedBackend, or a *HeaderError
+if a dht file belongs to another node, read documentation of SetSnapshotHeader.
+
+Returns:
+1. *DHT: The recovered dht, nil if error
+2. *Cache: The cache of the recovered dht
+3. string: The name of the new log file
+4. RecoveryReport: What the dht was recovered from and what was discarded
+5. error: A *RecoveryError in strict mode, a *KeyError, a *HeaderError, or error in saving the recovered dht, nil if no error
+*/
+func (s *Store) RecoverDHT() (*structures.DHT, *structures.Cache, string, RecoveryReport, error) {
+	logFiles := s.GetPersistanceFileNames(LOG)
+	dhtFiles := s.GetPersistanceFileNames(DHT)
 
 	// init variables
 	var l_ind int64
 	var d_ind int64
-	var l os.FileInfo
-	var d os.FileInfo
-	logStack := []os.FileInfo{}
+	var l string
+	var d string
+	logStack := []string{}
+	report := &RecoveryReport{}
 
 	i := 0 // index to logFiles
 	j := 0 // index to dhtFiles
@@ -437,27 +813,31 @@ func RecoverDHT() (*structures.DHT, string) {
 		l = logFiles[i] // TAKE CURRENT LOG
 		d = dhtFiles[j] // TAKE CURRENT DHT
 
-		l_ind, _ = GetFileIndex(l.Name(), LOG) // get log index
-		d_ind, _ = GetFileIndex(d.Name(), DHT) // get dht index
-
-		fmt.Println(l_ind, d_ind)
+		l_ind, _ = GetFileIndex(l, LOG) // get log index
+		d_ind, _ = GetFileIndex(d, DHT) // get dht index
 
 		// if log is ahead than dht , then push to stack
 		if l_ind > d_ind {
-			fmt.Println("Adding to log stack")
 			logStack = append(logStack, l)
 			i++
 			continue
 		}
 		// if log is behind the current DHT
-		dht, err := LoadDHTFile(d.Name())
+		dht, cache, err := s.LoadDHTFile(d)
 		// if error in reading DHT, go to next DHT
 		if err != nil {
-			fmt.Println(err)
+			if keyErr := keyError(d, err); keyErr != nil {
+				return nil, nil, "", *report, keyErr
+			}
+			if _, ok := err.(*HeaderError); ok {
+				return nil, nil, "", *report, err
+			}
+			report.snapshotUnreadable(d, err)
 			j++
 			continue
 		} else {
-			return processLogStack(dht, logStack, d_ind)
+			report.Snapshot = d
+			return s.processLogStack(dht, cache, logStack, d_ind, report)
 
 		}
 	}
@@ -465,15 +845,23 @@ func RecoverDHT() (*structures.DHT, string) {
 	// if all log files are processed, but dht isn't so, find one good dht, if found ,then process.
 	// else go to empty dht condition
 	for j < len(dhtFiles) {
-		d = dhtFiles[j] // TAKE CURRENT DHT
-		dht, err := LoadDHTFile(d.Name())
+		d = dhtFiles[j]                 // TAKE CURRENT DHT
+		d_ind, _ = GetFileIndex(d, DHT) // get dht index
+		dht, cache, err := s.LoadDHTFile(d)
 		// if error in reading DHT, go to next DHT
 		if err != nil {
-			fmt.Println(err)
+			if keyErr := keyError(d, err); keyErr != nil {
+				return nil, nil, "", *report, keyErr
+			}
+			if _, ok := err.(*HeaderError); ok {
+				return nil, nil, "", *report, err
+			}
+			report.snapshotUnreadable(d, err)
 			j++
 			continue
 		} else {
-			return processLogStack(dht, logStack, d_ind)
+			report.Snapshot = d
+			return s.processLogStack(dht, cache, logStack, d_ind, report)
 		}
 	}
 
@@ -481,97 +869,156 @@ func RecoverDHT() (*structures.DHT, string) {
 	// so we start from empty DHT
 	// traverse remaining logs into log stack and then process log stack
 	var dhtEmpty structures.DHT
+	var cacheEmpty structures.Cache
 
 	for i < len(logFiles) {
 		l = logFiles[i] // TAKE CURRENT LOG
 		// if log is ahead than dht , then push to stack
-		fmt.Println(l.Name())
-		fmt.Println("Adding to log stack")
 		logStack = append(logStack, l)
 		i++
 	}
 	if len(logStack) == 0 {
-		return &dhtEmpty, "log-1"
+		report.resolveSnapshots(-1)
+		if s.strictRecovery && len(report.Discarded) > 0 {
+			return nil, nil, "", *report, &RecoveryError{Report: *report}
+		}
+		return &dhtEmpty, &cacheEmpty, "log-1", *report, nil
 	}
-	lastLogIndex, _ := GetFileIndex(logStack[len(logStack)-1].Name(), LOG)
+	lastLogIndex, _ := GetFileIndex(logStack[len(logStack)-1], LOG)
 	d_ind = lastLogIndex - 1
-	return processLogStack(&dhtEmpty, logStack, d_ind)
+	return s.processLogStack(&dhtEmpty, &cacheEmpty, logStack, d_ind, report)
+}
+
+// RecoverDHT recovers the dht from the default store
+func RecoverDHT() (*structures.DHT, *structures.Cache, string, RecoveryReport, error) {
+	return defaultStore.RecoverDHT()
 }
 
-// helper function to recover log.
-func processLogStack(dht *structures.DHT, logStack []os.FileInfo, d_ind int64) (*structures.DHT, string) {
-	latestLogFileName := ""
+// helper function to recover log. The logs of the log stack are replayed oldest first,
+// the logs that can't be replayed and the ones after them are discarded.
+func (s *Store) processLogStack(dht *structures.DHT, cache *structures.Cache, logStack []string, d_ind int64, report *RecoveryReport) (*structures.DHT, *structures.Cache, string, RecoveryReport, error) {
+	// discardFrom discards the log at index i of the stack and every later one
+	discardFrom := func(i int, reason error) {
+		for ; i >= 0; i-- {
+			report.discard(logStack[i], reason)
+			reason = ErrLogNotCompatible
+		}
+	}
 
 	for i := len(logStack) - 1; i >= 0; i-- {
 		// get index of file, can't error out
-		lind, err := GetFileIndex(logStack[i].Name(), LOG)
+		lind, err := GetFileIndex(logStack[i], LOG)
 
 		// if error in file index or, the log is far ahead of the state of DHT, return that dht
 		// setup new file for logging.
 		if err != nil || d_ind != lind-1 {
-			fmt.Println("Log dht not compatible !")
-
-			// clear all logs in log folder and other dht's, rename dht and log to new index.
-			latestLogFileName = persistanceCleanUp(dht)
-			// make new_log-file,
-			return dht, latestLogFileName // log dht not compatible
+			discardFrom(i, ErrLogNotCompatible)
+			break
 		}
 
 		// open log file
-		file, err := os.Open("log/" + logStack[i].Name())
+		file, err := s.backend.Open(LOG, logStack[i])
 
 		// if error in opening file, clean up everything as before error scenario, and go with current DHT
 		if err != nil {
-			fmt.Println(err)
-			latestLogFileName = persistanceCleanUp(dht)
-			return dht, latestLogFileName // if error, then
+			if keyErr := keyError(logStack[i], err); keyErr != nil {
+				return nil, nil, "", *report, keyErr
+			}
+			discardFrom(i, err)
+			break
 		}
 
 		// no error in opening log file
 		// now use log and run all the operation of log in DHT
-		err = FlushLog(dht, file)
+		records, truncated, err := replayLog(dht, cache, file)
+		file.Close()
 
 		// if there is an error while flushing, that means problem with the log
 		// discard log and clean up operations.
 		if err != nil {
-			fmt.Println(err)
-			latestLogFileName = persistanceCleanUp(dht)
-			return dht, latestLogFileName // if error, then
+			if keyErr := keyError(logStack[i], err); keyErr != nil {
+				return nil, nil, "", *report, keyErr
+			}
+			// the records before a corrupt one have been applied
+			report.RecordsApplied += records
+			discardFrom(i, err)
+			break
+		}
+		report.LogsReplayed = append(report.LogsReplayed, logStack[i])
+		report.RecordsApplied += records
+		report.TruncatedBytes += truncated
+		// only the latest log can have records that were never synced
+		if truncated > 0 && i > 0 {
+			report.discard(logStack[i], fmt.Errorf("%d bytes of invalid records at the end of the log", truncated))
 		}
 
-		// if there is no error, then flushing has happened well.
-		file.Close()
 		// update state of DHT for next log
 		d_ind++
 
 	}
+	report.resolveSnapshots(d_ind)
+
+	if s.strictRecovery && len(report.Discarded) > 0 {
+		return nil, nil, "", *report, &RecoveryError{Report: *report}
+	}
 
 	// now clean up redundant log files and make new dht object file
-	latestLogFileName = persistanceCleanUp(dht)
-	return dht, latestLogFileName // if error, then
+	latestLogFileName, err := s.persistanceCleanUp(dht, cache)
+	if err != nil {
+		return nil, nil, "", *report, err
+	}
+	return dht, cache, latestLogFileName, *report, nil
 }
 
-// Saves dht gob to file
-func SaveDHT(path string, dht *structures.DHT) error {
-	file, err := os.Create(path)
+/*
+SaveDHT saves the dht snapshot as the dht file called name. The backend writes it
+atomically, so a crash leaves either the old file or the complete new one.
+
+Arguments:
+1. name: Name of the dht file
+2. dht: The DHT to be saved
+3. cache: The cache of the DHT, saved along with it
+Returns:
+1. error: nil if no error
+*/
+func (s *Store) SaveDHT(name string, dht *structures.DHT, cache *structures.Cache) error {
+	data, err := s.encodeSnapshot(dht, cache)
+	if err != nil {
+		return err
+	}
+	err = s.backend.WriteSnapshot(name, data)
 	if err == nil {
-		encoder := gob.NewEncoder(file)
-		encoder.Encode(dht)
+		s.snapshotSaved()
 	}
-	file.Close()
 	return err
 }
 
-// loads dht gob from file to memory
-func LoadDHTFile(path string) (*structures.DHT, error) {
-	dht := &structures.DHT{}
-	file, err := os.Open("dht/" + path)
-	if err == nil {
-		decoder := gob.NewDecoder(file)
-		err = decoder.Decode(dht)
+// SaveDHT saves the dht snapshot as the dht file called name in the default store
+func SaveDHT(name string, dht *structures.DHT, cache *structures.Cache) error {
+	return defaultStore.SaveDHT(name, dht, cache)
+}
+
+// loads dht and its cache from file to memory, dht files from before snapshots were protobufs are read as gobs
+func (s *Store) LoadDHTFile(name string) (*structures.DHT, *structures.Cache, error) {
+	file, err := s.backend.Open(DHT, name)
+	if err != nil {
+		return &structures.DHT{}, &structures.Cache{}, err
 	}
+	data, err := ioutil.ReadAll(file)
 	file.Close()
-	return dht, err
+	if err != nil {
+		return &structures.DHT{}, &structures.Cache{}, err
+	}
+	dht, cache, err := s.decodeDHTFile(data)
+	if headerErr, ok := err.(*HeaderError); ok {
+		headerErr.Name = name
+	}
+	return dht, cache, err
+}
+
+// LoadDHTFile loads the dht file called name from the default store
+func LoadDHTFile(name string) (*structures.DHT, *structures.Cache, error) {
+	return defaultStore.LoadDHTFile(name)
 }
 
 /*
@@ -581,6 +1028,15 @@ None
 Returns:
 error: nil if no error else some error
 */
+func (s *Store) ClosePersistance() error {
+	s.stopWriter()
+	if s.logFile == nil {
+		return os.ErrInvalid
+	}
+	return s.logFile.Close()
+}
+
+// ClosePersistance closes the log file of the default store
 func ClosePersistance() error {
-	return logFile.Close()
+	return defaultStore.ClosePersistance()
 }
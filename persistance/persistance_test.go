@@ -1,16 +1,35 @@
 package persistance_test
 
 import (
+	"bytes"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"hydra-dht/constants"
 	"hydra-dht/persistance"
+	pb "hydra-dht/protobuf/node"
 	"hydra-dht/structures"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// newTestStore returns a store keeping its files in memory, so tests don't share files
+func newTestStore() (*persistance.Store, persistance.Backend) {
+	backend := persistance.NewMemoryBackend()
+	return persistance.NewStoreWithBackend(backend), backend
+}
+
 func TestAppendToFile(t *testing.T) {
 
-	_, log, filePosition, _ := persistance.InitPersistance()
+	store, _ := newTestStore()
+	_, _, log, filePosition, _ := store.InitPersistance()
 
 	key := structures.NodeID{5, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124}
 
@@ -40,7 +59,7 @@ func TestAppendToFile(t *testing.T) {
 			Port:   int(test.port),
 		}
 
-		err := persistance.AppendToLog(node, test.dhtIndex, test.listIndex)
+		err := store.AppendToLog(node, structures.CacheObject{}, test.dhtIndex, test.listIndex)
 		if err != nil {
 			t.Errorf("%v", err)
 		}
@@ -60,16 +79,14 @@ func TestAppendToFile(t *testing.T) {
 		}
 
 	}
-	// clean up test log files
-	closingError := persistance.ClosePersistance()
+	closingError := store.ClosePersistance()
 	if closingError != nil {
 		t.Errorf("%v", closingError)
 	}
-	cleanUpHelper()
 }
 
-func CreateDHTandLog(fileIndex string) *structures.DHT {
-	logFile, _, _ := persistance.OpenLogFile("log-" + fileIndex)
+func CreateDHTandLog(store *persistance.Store, fileIndex string) *structures.DHT {
+	logFile, _, _ := store.OpenLogFile("log-" + fileIndex)
 
 	key := structures.NodeID{5, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124}
 
@@ -99,20 +116,22 @@ func CreateDHTandLog(fileIndex string) *structures.DHT {
 			Domain: test.domain,
 			Port:   int(test.port),
 		}
-		persistance.AppendToLogUtil(logFile, node, test.dhtIndex, test.listIndex)
+		persistance.AppendToLogUtil(logFile, node, structures.CacheObject{}, test.dhtIndex, test.listIndex)
 	}
 	// replay log on empty dht
 	var dht structures.DHT
-	persistance.FlushLog(&dht, logFile)
+	var cache structures.Cache
+	persistance.FlushLog(&dht, &cache, logFile)
 
-	persistance.ClosePersistance()
-	persistance.SaveDHT("dht/dht-"+fileIndex, &dht)
+	store.ClosePersistance()
+	store.SaveDHT("dht-"+fileIndex, &dht, &cache)
 	return &dht
 }
 
 func TestLoadDHT(t *testing.T) {
 
-	logFile, _, err := persistance.OpenLogFile("log-1")
+	store, _ := newTestStore()
+	logFile, _, err := store.OpenLogFile("log-1")
 	if err != nil {
 		t.Errorf("%v", err)
 	}
@@ -144,7 +163,7 @@ func TestLoadDHT(t *testing.T) {
 			Domain: test.domain,
 			Port:   int(test.port),
 		}
-		err := persistance.AppendToLog(node, test.dhtIndex, test.listIndex)
+		err := store.AppendToLog(node, structures.CacheObject{}, test.dhtIndex, test.listIndex)
 		if err != nil {
 			t.Errorf("%v", err)
 		}
@@ -153,7 +172,8 @@ func TestLoadDHT(t *testing.T) {
 
 	// replay log on empty dht
 	var dht structures.DHT
-	persistance.FlushLog(&dht, logFile)
+	var cache structures.Cache
+	persistance.FlushLog(&dht, &cache, logFile)
 
 	if err != nil {
 		t.Errorf("%v", err)
@@ -179,15 +199,438 @@ func TestLoadDHT(t *testing.T) {
 
 	}
 
-	// clean up test log files
-	closingError := persistance.ClosePersistance()
+	closingError := store.ClosePersistance()
 	if closingError != nil {
 		t.Errorf("%v", closingError)
 	}
-	cleanUpHelper()
 
 }
 
+func TestRemovalTombstone(t *testing.T) {
+
+	store, _ := newTestStore()
+	logFile, _, err := store.OpenLogFile("log-1")
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	key := structures.NodeID{5, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124}
+
+	var tests = []struct {
+		nodeId    byte
+		dhtIndex  int32
+		listIndex int32
+		removed   bool
+	}{
+
+		{1, 0, 0, false},
+		{2, 0, 1, false},
+		{3, 0, 2, false},
+		{1, 0, 0, true},
+		{3, 0, 1, true},
+	}
+	for _, test := range tests {
+
+		key[0] = test.nodeId
+
+		node := structures.Node{
+			Key:    key,
+			Domain: "127.0.0.1",
+			Port:   int(test.nodeId) * 10,
+		}
+		if test.removed {
+			err = store.AppendRemovalToLog(node, test.dhtIndex, test.listIndex)
+		} else {
+			err = store.AppendToLog(node, structures.CacheObject{}, test.dhtIndex, test.listIndex)
+		}
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+
+	// replay log on empty dht
+	var dht structures.DHT
+	var cache structures.Cache
+	_, err = persistance.FlushLog(&dht, &cache, logFile)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	if len(dht.Lists[0]) != 1 || dht.Lists[0][0].Key[0] != 2 {
+		t.Errorf("FlushLog => got bucket %v; want only the node with key 2", dht.Lists[0])
+	}
+
+	closingError := store.ClosePersistance()
+	if closingError != nil {
+		t.Errorf("%v", closingError)
+	}
+}
+
+func TestTouchRecord(t *testing.T) {
+	store, _ := newTestStore()
+	logFile, _, err := store.OpenLogFile("log-1")
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	nodes := make([]structures.Node, 3)
+	for i := range nodes {
+		nodes[i] = structures.Node{Key: structures.NodeID{byte(i + 1)}, Domain: "127.0.0.1", Port: 10}
+		store.AppendToLog(nodes[i], structures.CacheObject{}, 0, int32(i))
+	}
+	// the head of the bucket is seen and moves to the tail
+	seen := time.Unix(1500000000, 0)
+	err = <-store.AppendTouchToLogAsync(nodes[0], structures.CacheObject{LastTime: seen}, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	// positions of later records are those after the move
+	store.AppendToLog(structures.Node{Key: structures.NodeID{9}, Domain: "127.0.0.1", Port: 10}, structures.CacheObject{}, 0, 0)
+
+	var dht structures.DHT
+	var cache structures.Cache
+	_, err = persistance.FlushLog(&dht, &cache, logFile)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	bucket := dht.Lists[0]
+	if len(bucket) != 3 || bucket[0].Key[0] != 9 || bucket[1].Key[0] != 3 || bucket[2].Key[0] != 1 || !cache.Lists[0][2].LastTime.Equal(seen) {
+		t.Errorf("FlushLog => got bucket %v, cache %v; want [9 3 1] with node 1 seen", bucket, cache.Lists[0])
+	}
+	store.ClosePersistance()
+}
+
+func TestTornLog(t *testing.T) {
+
+	var tests = []struct {
+		corrupt   func(data []byte) []byte
+		nodes     int
+		truncated bool
+		err       bool
+	}{
+		// clean log
+		{func(data []byte) []byte { return data }, 3, false, false},
+		// half written header at the end
+		{func(data []byte) []byte { return append(data, 1, 30, 0, 0) }, 3, true, false},
+		// a byte of the last record flipped
+		{func(data []byte) []byte { data[len(data)-1] = 0xff; return data }, 2, true, false},
+		// last record cut short
+		{func(data []byte) []byte { return data[:len(data)-3] }, 2, true, false},
+		// a byte of the first record flipped, a crash can't have done that
+		{func(data []byte) []byte { data[constants.LOG_HEADER_BYTE_SIZE] ^= 0xff; return data }, 0, false, true},
+		// unknown version of the first record
+		{func(data []byte) []byte { data[0] = 9; return data }, 0, false, true},
+	}
+	for _, test := range tests {
+		store, backend := newTestStore()
+		logFile, _, err := store.OpenLogFile("log-1")
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+		key := structures.NodeID{5, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124}
+		for i := 0; i < 3; i++ {
+			key[0] = byte(i)
+			persistance.AppendToLogUtil(logFile, structures.Node{Key: key, Domain: "127.0.0.1", Port: 10}, structures.CacheObject{}, 0, int32(i))
+		}
+		store.ClosePersistance()
+
+		// rewrite the log as a crash would have left it
+		data, _ := readFile(backend, persistance.LOG, "log-1")
+		logFile, _ = backend.CreateLog("log-1")
+		logFile.Append(test.corrupt(data))
+
+		var dht structures.DHT
+		var cache structures.Cache
+		truncated, err := persistance.FlushLog(&dht, &cache, logFile)
+		if (err != nil) != test.err || (err != nil && !strings.HasPrefix(err.Error(), persistance.ErrCorruptRecord.Error())) {
+			t.Errorf("FlushLog => (ERROR)= %v;want error %v", err, test.err)
+		}
+		if len(dht.Lists[0]) != test.nodes || (truncated > 0) != test.truncated {
+			t.Errorf("FlushLog => (NODES)= %d;want %d | (TRUNCATED)= %d bytes", len(dht.Lists[0]), test.nodes, truncated)
+		}
+	}
+}
+
+// readFile reads the whole file of fileType from the backend
+func readFile(backend persistance.Backend, fileType persistance.PERSISTANCE_FILE, name string) ([]byte, error) {
+	file, err := backend.Open(fileType, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+func TestSaveDHT(t *testing.T) {
+	store, _ := newTestStore()
+	dht := CreateDHTandLog(store, "1")
+
+	// overwrite the saved dht, the new one should replace it whole
+	dht.Lists[7] = append(dht.Lists[7], dht.Lists[0][0])
+	err := store.SaveDHT("dht-1", dht, nil)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	loaded, _, err := store.LoadDHTFile("dht-1")
+	if err != nil {
+		t.Errorf("%v", err)
+	} else if len(loaded.Lists[7]) != 1 || len(loaded.Lists[0]) != 3 {
+		t.Errorf("LoadDHTFile => got %d nodes in bucket 7 and %d in bucket 0; want 1 and 3", len(loaded.Lists[7]), len(loaded.Lists[0]))
+	}
+}
+
+func TestCachePersisted(t *testing.T) {
+	store, _ := newTestStore()
+	_, _, _, _, err := store.InitPersistance()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := time.Unix(0, 1546300800000000000)
+	var tests = []struct {
+		key   structures.NodeID
+		cache structures.CacheObject
+	}{
+		{structures.NodeID{1}, structures.CacheObject{LastTime: seen, Dead: false}},
+		{structures.NodeID{2}, structures.CacheObject{LastTime: seen.Add(time.Minute), Dead: true}},
+		{structures.NodeID{3}, structures.CacheObject{}},
+	}
+	for i, test := range tests {
+		node := structures.Node{Key: test.key, Domain: "127.0.0.1", Port: 10}
+		if err := store.AppendToLog(node, test.cache, 0, int32(i)); err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+	store.ClosePersistance()
+
+	checkCache := func(from string, dht *structures.DHT, cache *structures.Cache) {
+		if len(cache.Lists[0]) != len(dht.Lists[0]) || len(cache.Lists[0]) != len(tests) {
+			t.Errorf("%s => got %d nodes and %d cache entries; want %d of both", from, len(dht.Lists[0]), len(cache.Lists[0]), len(tests))
+			return
+		}
+		for i, test := range tests {
+			c := cache.Lists[0][i]
+			if !c.LastTime.Equal(test.cache.LastTime) || c.Dead != test.cache.Dead {
+				t.Errorf("%s => (CACHE %d)= %v;want %v", from, i, c, test.cache)
+			}
+		}
+	}
+
+	// recovery replays the log and saves the dht along with its cache
+	dht, cache, _, _, err := store.InitPersistance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.ClosePersistance()
+	checkCache("InitPersistance", dht, cache)
+
+	dht, cache, err = store.LoadDHTFile("dht-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCache("LoadDHTFile", dht, cache)
+}
+
+func TestCompactionPolicy(t *testing.T) {
+	store, _ := newTestStore()
+	store.SetCompactionPolicy(3, 0)
+	store.InitPersistance()
+	defer store.ClosePersistance()
+
+	if stats := store.Stats(); stats.LogRecords != 0 || !stats.LastSnapshot.IsZero() {
+		t.Errorf("Stats of a new store => %+v;want an empty log and no snapshot", stats)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-store.CompactionDue():
+			t.Errorf("CompactionDue after %d records;want after 3", i)
+		default:
+		}
+		store.AppendToLog(structures.Node{Key: structures.NodeID{byte(i)}, Domain: "127.0.0.1", Port: 10}, structures.CacheObject{}, 0, int32(i))
+	}
+
+	select {
+	case <-store.CompactionDue():
+	default:
+		t.Errorf("CompactionDue => nothing after 3 records;want a receive")
+	}
+	stats := store.Stats()
+	if !store.NeedsCompaction() || stats.LogRecords != 3 || stats.LogBytes == 0 {
+		t.Errorf("Stats => %+v | (NEEDS COMPACTION)= %v;want 3 records", stats, store.NeedsCompaction())
+	}
+
+	last := stats.LastSnapshot
+	store.PersistDHT(structures.DHT{}, structures.Cache{})
+	stats = store.Stats()
+	if store.NeedsCompaction() || stats.LogRecords != 0 || stats.LogBytes != 0 || !stats.LastSnapshot.After(last) {
+		t.Errorf("Stats after PersistDHT => %+v;want an empty log and a later snapshot", stats)
+	}
+
+	// a byte limit compacts as well
+	store.SetCompactionPolicy(0, 1)
+	store.AppendToLog(structures.Node{Key: structures.NodeID{9}, Domain: "127.0.0.1", Port: 10}, structures.CacheObject{}, 0, 0)
+	if !store.NeedsCompaction() {
+		t.Errorf("NeedsCompaction => false past the byte limit;want true")
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	store, _ := newTestStore()
+	store.SetCommitLatency(20 * time.Millisecond)
+	logFile, _, err := store.OpenLogFile("log-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent appends from every row
+	var wg sync.WaitGroup
+	for row := 0; row < 64; row++ {
+		wg.Add(1)
+		go func(row int) {
+			defer wg.Done()
+			node := structures.Node{Key: structures.NodeID{uint8(row)}, Domain: "127.0.0.1", Port: row}
+			if err := store.AppendToLog(node, structures.CacheObject{}, int32(row), 0); err != nil {
+				t.Errorf("%v", err)
+			}
+		}(row)
+	}
+	wg.Wait()
+
+	// queued appends are written in order
+	var queued []<-chan error
+	for i := 0; i < 5; i++ {
+		node := structures.Node{Key: structures.NodeID{100, uint8(i)}, Domain: "127.0.0.1", Port: i}
+		queued = append(queued, store.AppendToLogAsync(node, structures.CacheObject{}, 100, int32(i)))
+	}
+	queued = append(queued, store.AppendRemovalToLogAsync(structures.Node{Key: structures.NodeID{100, 2}}, 100, 2))
+	for _, c := range queued {
+		if err := <-c; err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+
+	var dht structures.DHT
+	var cache structures.Cache
+	truncated, err := persistance.FlushLog(&dht, &cache, logFile)
+	if err != nil || truncated != 0 {
+		t.Errorf("FlushLog => (TRUNCATED)= %d bytes | (ERROR)= %v", truncated, err)
+	}
+	for row := 0; row < 64; row++ {
+		if len(dht.Lists[row]) != 1 || dht.Lists[row][0].Port != row {
+			t.Errorf("FlushLog => (BUCKET %d)= %v;want the node appended", row, dht.Lists[row])
+		}
+	}
+	var ports []int
+	for _, n := range dht.Lists[100] {
+		ports = append(ports, n.Port)
+	}
+	if fmt.Sprint(ports) != "[0 1 3 4]" {
+		t.Errorf("FlushLog => (BUCKET 100 PORTS)= %v;want [0 1 3 4]", ports)
+	}
+	store.ClosePersistance()
+}
+
+func TestNewStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "hydra-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "data")
+	store, err := persistance.NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, folder := range []string{"log", "dht"} {
+		if _, err := os.Stat(filepath.Join(dir, folder)); err != nil {
+			t.Errorf("%s folder => %v; want it created on first run", folder, err)
+		}
+	}
+
+	dht, _, _, _, err := store.InitPersistance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := structures.NodeID{1}
+	err = store.AppendToLog(structures.Node{Key: key, Domain: "127.0.0.1", Port: 10}, structures.CacheObject{}, 3, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	store.ClosePersistance()
+
+	// the files live in the data dir, not in the working directory
+	if _, err := os.Stat(filepath.Join(dir, "log", "log-1")); err != nil {
+		t.Errorf("log-1 => %v; want it in the data dir", err)
+	}
+
+	dht, _, _, _, err = store.InitPersistance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.ClosePersistance()
+	if len(dht.Lists[3]) != 1 || dht.Lists[3][0].Key != key {
+		t.Errorf("recovered bucket 3 => %v; want the logged node", dht.Lists[3])
+	}
+
+	// snapshots are written through a temporary file that is renamed over the dht file
+	err = store.SaveDHT("dht-1", &structures.DHT{}, nil)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dht", "dht-1.tmp")); !os.IsNotExist(err) {
+		t.Errorf("SaveDHT left its temporary file behind")
+	}
+
+	// the temporary file of a snapshot a crash interrupted is removed on the next run
+	temp := filepath.Join(dir, "dht", "dht-2.tmp")
+	ioutil.WriteFile(temp, []byte("half a snapshot"), 0644)
+	store, err = persistance.NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Errorf("NewStore left the stale temporary file behind")
+	}
+	// files the store didn't write are skipped
+	logs := fmt.Sprint(store.GetPersistanceFileNames(persistance.LOG))
+	ioutil.WriteFile(filepath.Join(dir, "log", "notes.txt"), nil, 0644)
+	if files := fmt.Sprint(store.GetPersistanceFileNames(persistance.LOG)); files != logs {
+		t.Errorf("GetPersistanceFileNames(LOG) with a stray file => %s;want %s", files, logs)
+	}
+}
+
+func TestLoadLegacyDHT(t *testing.T) {
+	store, backend := newTestStore()
+	dht := CreateDHTandLog(store, "1")
+
+	// dht files used to be gobs of the DHT
+	var legacy bytes.Buffer
+	gob.NewEncoder(&legacy).Encode(dht)
+	err := backend.WriteSnapshot("dht-2", legacy.Bytes())
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	var tests = []struct {
+		fileName string
+	}{
+		{"dht-1"}, // snapshot
+		{"dht-2"}, // legacy gob
+	}
+	for _, test := range tests {
+		loaded, _, err := store.LoadDHTFile(test.fileName)
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		for row := range dht.Lists {
+			if len(loaded.Lists[row]) != len(dht.Lists[row]) {
+				t.Errorf("LoadDHTFile(%s) => got %d nodes in bucket %d; want %d", test.fileName, len(loaded.Lists[row]), row, len(dht.Lists[row]))
+			}
+		}
+	}
+}
+
 func TestGetLogFileName(t *testing.T) {
 	var tests = []struct {
 		fileIndex string
@@ -195,16 +638,15 @@ func TestGetLogFileName(t *testing.T) {
 
 		{"1"},
 	}
+	store, _ := newTestStore()
 	for _, test := range tests {
-		CreateDHTandLog(test.fileIndex)
+		CreateDHTandLog(store, test.fileIndex)
 	}
-	files := persistance.GetPersistanceFileNames(persistance.LOG)
+	files := store.GetPersistanceFileNames(persistance.LOG)
 	if len(files) != 1 {
 		t.Errorf("Wanted 1 log file but got %d number of files in Log", len(files))
 	}
 
-	cleanUpHelper()
-
 }
 
 func TestGetFileIndex(t *testing.T) {
@@ -234,20 +676,19 @@ func TestRecover(t *testing.T) {
 		{"2"},
 		{"3"},
 	}
+	store, backend := newTestStore()
 	for _, test := range tests {
-		CreateDHTandLog(test.fileIndex)
+		CreateDHTandLog(store, test.fileIndex)
 	}
 
-	cleanUpDHTs()
+	cleanUpDHTs(store, backend)
 
-	_, filename := persistance.RecoverDHT()
+	_, _, filename, _, _ := store.RecoverDHT()
 	fmt.Println(filename)
 	if filename != "log-1" {
 		t.Errorf("Wanted filename: log-1, but got %v", filename)
 	}
 
-	cleanUpHelper()
-
 	tests = []struct {
 		fileIndex string
 	}{
@@ -256,20 +697,19 @@ func TestRecover(t *testing.T) {
 		{"2"},
 		{"3"},
 	}
+	store, backend = newTestStore()
 	for _, test := range tests {
-		CreateDHTandLog(test.fileIndex)
+		CreateDHTandLog(store, test.fileIndex)
 	}
 
-	cleanUpLogs()
+	cleanUpLogs(store, backend)
 
-	_, filename = persistance.RecoverDHT()
+	_, _, filename, _, _ = store.RecoverDHT()
 	fmt.Println(filename)
 	if filename != "log-1" {
 		t.Errorf("Wanted filename: log-1, but got %v", filename)
 	}
 
-	cleanUpHelper()
-
 	tests = []struct {
 		fileIndex string
 	}{
@@ -278,18 +718,17 @@ func TestRecover(t *testing.T) {
 		{"2"},
 		{"3"},
 	}
+	store, backend = newTestStore()
 	for _, test := range tests {
-		CreateDHTandLog(test.fileIndex)
+		CreateDHTandLog(store, test.fileIndex)
 	}
 
-	_, filename = persistance.RecoverDHT()
+	_, _, filename, _, _ = store.RecoverDHT()
 	fmt.Println(filename)
 	if filename != "log-1" {
 		t.Errorf("Wanted filename: log-1, but got %v", filename)
 	}
 
-	cleanUpHelper()
-
 	tests = []struct {
 		fileIndex string
 	}{
@@ -298,25 +737,185 @@ func TestRecover(t *testing.T) {
 		{"2"},
 		{"10"},
 	}
+	store, backend = newTestStore()
 	for _, test := range tests {
-		CreateDHTandLog(test.fileIndex)
+		CreateDHTandLog(store, test.fileIndex)
 	}
 
-	cleanUpDHTsBut("dht-1")
+	cleanUpDHTsBut(store, backend, "dht-1")
 
-	_, filename = persistance.RecoverDHT()
+	_, _, filename, _, _ = store.RecoverDHT()
 	fmt.Println(filename)
 	if filename != "log-1" {
 		t.Errorf("Wanted filename: log-1, but got %v", filename)
 	}
 
-	cleanUpHelper()
+}
 
+// writeTestLog writes a log file of the backend with a node for each of the first bytes
+func writeTestLog(backend persistance.Backend, name string, firstBytes ...byte) {
+	logFile, _ := backend.CreateLog(name)
+	for i, b := range firstBytes {
+		persistance.AppendToLogUtil(logFile, structures.Node{Key: structures.NodeID{b}, Domain: "127.0.0.1", Port: 10}, structures.CacheObject{}, 0, int32(i))
+	}
+	logFile.Close()
+}
+
+func TestRecoveryReport(t *testing.T) {
+	var tests = []struct {
+		name      string
+		setup     func(store *persistance.Store, backend persistance.Backend)
+		snapshot  string
+		replayed  string
+		records   int
+		nodes     int
+		discarded string
+		skipped   string
+	}{
+		{"clean", func(store *persistance.Store, backend persistance.Backend) {
+			store.SaveDHT("dht-1", &structures.DHT{}, nil)
+			writeTestLog(backend, "log-2", 1, 2)
+		}, "dht-1", "[log-2]", 2, 2, "[]", "[]"},
+		{"torn tail of the latest log", func(store *persistance.Store, backend persistance.Backend) {
+			store.SaveDHT("dht-0", &structures.DHT{}, nil)
+			writeTestLog(backend, "log-1", 1)
+			logFile, _ := backend.CreateLog("log-2")
+			persistance.AppendToLogUtil(logFile, structures.Node{Key: structures.NodeID{2}}, structures.CacheObject{}, 0, 1)
+			logFile.Append([]byte{1, 30, 0})
+		}, "dht-0", "[log-1 log-2]", 2, 2, "[]", "[]"},
+		{"unreadable snapshot the logs cover", func(store *persistance.Store, backend persistance.Backend) {
+			store.SaveDHT("dht-0", &structures.DHT{}, nil)
+			writeTestLog(backend, "log-1", 1)
+			backend.WriteSnapshot("dht-1", []byte("garbage"))
+			writeTestLog(backend, "log-2", 1, 2)
+		}, "dht-0", "[log-1 log-2]", 3, 2, "[]", "[dht-1]"},
+		{"no readable snapshot", func(store *persistance.Store, backend persistance.Backend) {
+			backend.WriteSnapshot("dht-1", []byte("garbage"))
+			writeTestLog(backend, "log-2", 1)
+		}, "", "[log-2]", 1, 1, "[dht-1]", "[]"},
+		{"log missing in between", func(store *persistance.Store, backend persistance.Backend) {
+			store.SaveDHT("dht-1", &structures.DHT{}, nil)
+			writeTestLog(backend, "log-3", 1)
+		}, "dht-1", "[]", 0, 0, "[log-3]", "[]"},
+		{"torn tail of an older log", func(store *persistance.Store, backend persistance.Backend) {
+			store.SaveDHT("dht-0", &structures.DHT{}, nil)
+			logFile, _ := backend.CreateLog("log-1")
+			persistance.AppendToLogUtil(logFile, structures.Node{Key: structures.NodeID{1}}, structures.CacheObject{}, 0, 0)
+			logFile.Append([]byte{1, 30, 0})
+			writeTestLog(backend, "log-2", 1, 2)
+		}, "dht-0", "[log-1 log-2]", 3, 2, "[log-1]", "[]"},
+		{"unreadable snapshot the logs don't cover", func(store *persistance.Store, backend persistance.Backend) {
+			// log-2 was folded into dht-2 and removed, only dht-2 had its records
+			store.SaveDHT("dht-1", &structures.DHT{}, nil)
+			backend.WriteSnapshot("dht-2", []byte("garbage"))
+			writeTestLog(backend, "log-3", 1)
+		}, "dht-1", "[]", 0, 0, "[log-3 dht-2]", "[]"},
+		{"corrupt record before synced ones", func(store *persistance.Store, backend persistance.Backend) {
+			store.SaveDHT("dht-0", &structures.DHT{}, nil)
+			writeTestLog(backend, "log-1", 1, 2, 3)
+			data, _ := readFile(backend, persistance.LOG, "log-1")
+			data[constants.LOG_HEADER_BYTE_SIZE] ^= 0xff
+			logFile, _ := backend.CreateLog("log-1")
+			logFile.Append(data)
+		}, "dht-0", "[]", 0, 0, "[log-1]", "[]"},
+	}
+
+	names := func(files []persistance.DiscardedFile) string {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+		return fmt.Sprint(names)
+	}
+	for _, test := range tests {
+		store, backend := newTestStore()
+		test.setup(store, backend)
+
+		// a strict recovery refuses to discard anything, and leaves the files as they were
+		strict := persistance.NewStoreWithBackend(backend)
+		strict.SetStrictRecovery(true)
+		files := fmt.Sprint(strict.GetPersistanceFileNames(persistance.LOG), strict.GetPersistanceFileNames(persistance.DHT))
+		_, _, _, _, err := strict.InitPersistance()
+		_, refused := err.(*persistance.RecoveryError)
+		if refused != (test.discarded != "[]") {
+			t.Errorf("%s: strict InitPersistance => %v;want refused %v", test.name, err, test.discarded != "[]")
+		}
+		if refused {
+			if after := fmt.Sprint(strict.GetPersistanceFileNames(persistance.LOG), strict.GetPersistanceFileNames(persistance.DHT)); after != files {
+				t.Errorf("%s: files after strict recovery => %s;want %s", test.name, after, files)
+			}
+			if names(strict.LastRecovery().Discarded) != test.discarded {
+				t.Errorf("%s: refused recovery => discarded %s;want %s", test.name, names(strict.LastRecovery().Discarded), test.discarded)
+			}
+		} else {
+			strict.ClosePersistance()
+			store, backend = newTestStore()
+			test.setup(store, backend)
+		}
+
+		dht, _, _, report, err := store.RecoverDHT()
+		if err != nil {
+			t.Errorf("%s: RecoverDHT => %v", test.name, err)
+			continue
+		}
+		if report.Snapshot != test.snapshot || fmt.Sprint(report.LogsReplayed) != test.replayed || report.RecordsApplied != test.records ||
+			names(report.Discarded) != test.discarded || names(report.Skipped) != test.skipped {
+			t.Errorf("%s: RecoveryReport => %+v;want snapshot %q, replayed %s, %d records, discarded %s, skipped %s",
+				test.name, report, test.snapshot, test.replayed, test.records, test.discarded, test.skipped)
+		}
+		if len(dht.Lists[0]) != test.nodes {
+			t.Errorf("%s: recovered bucket 0 => %d nodes;want %d", test.name, len(dht.Lists[0]), test.nodes)
+		}
+	}
+}
+
+func TestSnapshotHeader(t *testing.T) {
+	self := structures.NodeID{1, 2, 3}
+	var tests = []struct {
+		name       string
+		nodeID     structures.NodeID
+		bucketSize int
+		refused    bool
+	}{
+		{"same node", self, 20, false},
+		{"other node", structures.NodeID{9}, 20, true},
+		{"other bucket size", self, 8, true},
+		{"no header set", structures.NodeID{}, 0, false},
+	}
+	for _, test := range tests {
+		store, backend := newTestStore()
+		store.SetSnapshotHeader(self, 20)
+		store.SaveDHT("dht-1", &structures.DHT{}, nil)
+		writeTestLog(backend, "log-2", 1)
+
+		// strict or not, a dht file of another node is never discarded
+		for _, strict := range []bool{true, false} {
+			other := persistance.NewStoreWithBackend(backend)
+			if test.bucketSize != 0 {
+				other.SetSnapshotHeader(test.nodeID, test.bucketSize)
+			}
+			other.SetStrictRecovery(strict)
+			files := fmt.Sprint(other.GetPersistanceFileNames(persistance.LOG), other.GetPersistanceFileNames(persistance.DHT))
+			dht, _, _, _, err := other.InitPersistance()
+			_, refused := err.(*persistance.HeaderError)
+			if refused != test.refused || (!refused && (err != nil || len(dht.Lists[0]) != 1)) {
+				t.Errorf("%s: InitPersistance (STRICT)= %v => %v;want refused %v", test.name, strict, err, test.refused)
+			}
+			if !refused {
+				other.ClosePersistance()
+				break
+			}
+			if after := fmt.Sprint(other.GetPersistanceFileNames(persistance.LOG), other.GetPersistanceFileNames(persistance.DHT)); after != files {
+				t.Errorf("%s: files after InitPersistance (STRICT)= %v => %s;want %s", test.name, strict, after, files)
+			}
+		}
+	}
 }
 
 func TestPeriodicSyncDHT(t *testing.T) {
 
-	persistance.InitPersistance()
+	store, _ := newTestStore()
+	store.InitPersistance()
 	var dht *structures.DHT
 	var tests = []struct {
 		fileIndex string
@@ -324,51 +923,428 @@ func TestPeriodicSyncDHT(t *testing.T) {
 		{"121"},
 	}
 	for _, test := range tests {
-		dht = CreateDHTandLog(test.fileIndex)
+		dht = CreateDHTandLog(store, test.fileIndex)
 	}
 
-	persistance.PersistDHT(*dht)
-	logfiles := persistance.GetPersistanceFileNames(persistance.LOG)
-	dhtfiles := persistance.GetPersistanceFileNames(persistance.DHT)
+	store.PersistDHT(*dht, structures.Cache{})
+	logfiles := store.GetPersistanceFileNames(persistance.LOG)
+	dhtfiles := store.GetPersistanceFileNames(persistance.DHT)
 
-	logindex, err := persistance.GetFileIndex(string(logfiles[0].Name()), persistance.LOG)
-	dhtindex, err := persistance.GetFileIndex(string(dhtfiles[0].Name()), persistance.DHT)
+	logindex, err := persistance.GetFileIndex(logfiles[0], persistance.LOG)
+	dhtindex, err := persistance.GetFileIndex(dhtfiles[0], persistance.DHT)
 	if len(logfiles) != 1 || len(dhtfiles) != 1 || logindex != 2 || dhtindex != 1 {
 		t.Errorf("Wanted 1 log file and 1 dht file but got %d number of files in Log and %d files in dht", len(logfiles), len(dhtfiles))
 	} else if err != nil {
 		t.Errorf("%v", err)
 	}
+	store.ClosePersistance()
+}
+
+func TestBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydra-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileBackend, err := persistance.NewFileBackend(filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	boltBackend, err := persistance.NewBoltBackend(filepath.Join(dir, "hydra.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name    string
+		backend persistance.Backend
+	}{
+		{"file", fileBackend},
+		{"memory", persistance.NewMemoryBackend()},
+		{"bolt", boltBackend},
+	}
+	for _, test := range tests {
+		logFile, err := test.backend.CreateLog("log-1")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		logFile.Append([]byte("hydra"))
+		logFile.Append([]byte("-dht"))
+		test.backend.WriteSnapshot("dht-0", []byte("old"))
+		test.backend.WriteSnapshot("dht-0", []byte("snapshot"))
+
+		// logs are read back while they are appended to
+		logFile.Seek(0, 0)
+		appended, _ := ioutil.ReadAll(logFile)
+		logFile.Close()
+		data, err := readFile(test.backend, persistance.LOG, "log-1")
+		snapshot, _ := readFile(test.backend, persistance.DHT, "dht-0")
+		if err != nil || string(data) != "hydra-dht" || string(appended) != "hydra-dht" || string(snapshot) != "snapshot" {
+			t.Errorf("%s: read back => (LOG)= %q %q | (DHT)= %q | (ERROR)= %v;want hydra-dht and snapshot", test.name, data, appended, snapshot, err)
+		}
+
+		// recreating a log empties it
+		logFile, _ = test.backend.CreateLog("log-1")
+		logFile.Close()
+		if data, _ := readFile(test.backend, persistance.LOG, "log-1"); len(data) != 0 {
+			t.Errorf("%s: recreated log => %q;want empty", test.name, data)
+		}
+
+		test.backend.CreateLog("log-2")
+		logs, _ := test.backend.List(persistance.LOG)
+		sort.Strings(logs)
+		if fmt.Sprint(logs) != "[log-1 log-2]" {
+			t.Errorf("%s: List => %v;want [log-1 log-2]", test.name, logs)
+		}
+
+		test.backend.Delete(persistance.LOG, "log-1")
+		test.backend.Delete(persistance.DHT, "dht-0")
+		logs, _ = test.backend.List(persistance.LOG)
+		dhts, _ := test.backend.List(persistance.DHT)
+		if len(logs) != 1 || len(dhts) != 0 {
+			t.Errorf("%s: after Delete => (LOGS)= %v | (DHTS)= %v;want [log-2] and none", test.name, logs, dhts)
+		}
+		if _, err := test.backend.Open(persistance.DHT, "dht-0"); !os.IsNotExist(err) {
+			t.Errorf("%s: Open deleted file => %v;want not exist", test.name, err)
+		}
+
+		// a store recovers what it logged on every backend
+		store := persistance.NewStoreWithBackend(test.backend)
+		store.InitPersistance()
+		store.AppendToLog(structures.Node{Key: structures.NodeID{1}, Domain: "127.0.0.1", Port: 10}, structures.CacheObject{}, 4, 0)
+		store.PersistDHT(structures.DHT{}, structures.Cache{})
+		store.AppendToLog(structures.Node{Key: structures.NodeID{2}, Domain: "127.0.0.1", Port: 20}, structures.CacheObject{}, 4, 0)
+		store.ClosePersistance()
+
+		dht, _, _, _, err := store.InitPersistance()
+		store.ClosePersistance()
+		if err != nil || len(dht.Lists[4]) != 1 || dht.Lists[4][0].Port != 20 {
+			t.Errorf("%s: recovered bucket 4 => %v | (ERROR)= %v;want the node logged after the snapshot", test.name, dht.Lists[4], err)
+		}
+
+		if err := test.backend.Close(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestBoltLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydra-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hydra.db")
 
-	cleanUpHelper()
+	backend, err := persistance.NewBoltBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a database in use is given up on after the timeout instead of blocking forever
+	if _, err := persistance.NewBoltBackend(path); !errors.Is(err, persistance.ErrDatabaseLocked) {
+		t.Errorf("NewBoltBackend of a database in use => %v;want ErrDatabaseLocked", err)
+	}
+	if _, err := persistance.OpenBoltBackend(path); !errors.Is(err, persistance.ErrDatabaseLocked) {
+		t.Errorf("OpenBoltBackend of a database in use => %v;want ErrDatabaseLocked", err)
+	}
+	backend.Close()
+
+	reader, err := persistance.OpenBoltBackend(path)
+	if err != nil {
+		t.Fatalf("OpenBoltBackend once the database is closed => %v;want nil", err)
+	}
+	reader.Close()
 }
 
-func cleanUpHelper() {
-	cleanUpLogs()
-	cleanUpDHTs()
+// newTestKeyring returns a keyring with a key for each of the ids, the last one active
+func newTestKeyring(ids ...uint32) *persistance.Keyring {
+	keys := persistance.NewKeyring()
+	for _, id := range ids {
+		key := bytes.Repeat([]byte{byte(id)}, 32)
+		keys.AddKey(id, key)
+	}
+	return keys
+}
+
+func TestEncryptedBackend(t *testing.T) {
+	raw := persistance.NewMemoryBackend()
+	lab := structures.Node{Key: structures.NodeID{1}, Domain: "lab-machine-7.internal", Port: 10}
+
+	store := persistance.NewStoreWithBackend(persistance.NewEncryptedBackend(raw, newTestKeyring(1)))
+	store.InitPersistance()
+	store.AppendToLog(lab, structures.CacheObject{}, 0, 0)
+	var dht structures.DHT
+	dht.Lists[0] = []structures.Node{lab}
+	store.PersistDHT(dht, structures.Cache{})
+	store.AppendToLog(structures.Node{Key: structures.NodeID{2}, Domain: "lab-machine-8.internal", Port: 10}, structures.CacheObject{}, 0, 1)
+	store.ClosePersistance()
+
+	// nothing of the nodes is written in the clear
+	for _, fileType := range []persistance.PERSISTANCE_FILE{persistance.LOG, persistance.DHT} {
+		names, _ := raw.List(fileType)
+		for _, name := range names {
+			data, _ := readFile(raw, fileType, name)
+			if bytes.Contains(data, []byte("lab-machine")) {
+				t.Errorf("%s => has a hostname in the clear", name)
+			}
+		}
+	}
 
+	// the log being appended to reads back decrypted from the wrapped log
+	encrypted := persistance.NewEncryptedBackend(persistance.NewMemoryBackend(), newTestKeyring(1))
+	logFile, _ := encrypted.CreateLog("log-1")
+	persistance.AppendToLogUtil(logFile, lab, structures.CacheObject{}, 0, 0)
+	var appended structures.DHT
+	_, err := persistance.FlushLog(&appended, &structures.Cache{}, logFile)
+	if err != nil || len(appended.Lists[0]) != 1 {
+		t.Errorf("FlushLog of an encrypted log => %v | (ERROR)= %v;want the appended node", appended.Lists[0], err)
+	}
+
+	// without the key file recovery can't read the files, strict or not it refuses to drop them
+	files := func() string {
+		store := persistance.NewStoreWithBackend(raw)
+		return fmt.Sprint(store.GetPersistanceFileNames(persistance.LOG), store.GetPersistanceFileNames(persistance.DHT))
+	}
+	before := files()
+	for _, strict := range []bool{true, false} {
+		plain := persistance.NewStoreWithBackend(raw)
+		plain.SetStrictRecovery(strict)
+		_, _, _, _, err := plain.InitPersistance()
+		if _, ok := err.(*persistance.KeyError); !ok {
+			t.Errorf("InitPersistance without key (STRICT)= %v => %v;want a key error", strict, err)
+		}
+		if after := files(); after != before {
+			t.Errorf("files after InitPersistance without key (STRICT)= %v => %s;want %s", strict, after, before)
+		}
+	}
+	// a missing key is as fatal as a missing key file
+	_, _, _, _, err = persistance.NewStoreWithBackend(persistance.NewEncryptedBackend(raw, newTestKeyring(3))).InitPersistance()
+	if _, ok := err.(*persistance.KeyError); !ok {
+		t.Errorf("InitPersistance with an unknown key => %v;want a key error", err)
+	}
+
+	// the key is rotated, the generation of the old key is still recovered
+	rotated := persistance.NewStoreWithBackend(persistance.NewEncryptedBackend(raw, newTestKeyring(1, 2)))
+	rotated.SetStrictRecovery(true)
+	recovered, _, _, _, err := rotated.InitPersistance()
+	rotated.ClosePersistance()
+	if err != nil || len(recovered.Lists[0]) != 2 {
+		t.Errorf("InitPersistance after rotation => %v | (ERROR)= %v;want both nodes", recovered.Lists[0], err)
+	}
+
+	// recovery rewrote the files with the new key, so the old one can be dropped
+	newKey := persistance.NewStoreWithBackend(persistance.NewEncryptedBackend(raw, newTestKeyring(2)))
+	newKey.SetStrictRecovery(true)
+	recovered, _, _, _, err = newKey.InitPersistance()
+	if err != nil || len(recovered.Lists[0]) != 2 {
+		t.Errorf("InitPersistance with the new key => %v | (ERROR)= %v;want both nodes", recovered.Lists[0], err)
+	}
+
+	// a torn frame at the end of the log is truncated like a torn record
+	newKey.AppendToLog(lab, structures.CacheObject{Dead: true}, 0, 0)
+	newKey.ClosePersistance()
+	data, _ := readFile(raw, persistance.LOG, "log-1")
+	logFile, _ = raw.CreateLog("log-1")
+	logFile.Append(data[:len(data)-5])
+	_, _, _, report, err := persistance.NewStoreWithBackend(persistance.NewEncryptedBackend(raw, newTestKeyring(2))).RecoverDHT()
+	if err != nil || report.TruncatedBytes == 0 || len(report.Discarded) != 0 {
+		t.Errorf("RecoverDHT of a torn frame => %+v | (ERROR)= %v;want it truncated", report, err)
+	}
+
+	// a corrupt frame followed by a good one isn't torn, strict recovery refuses it
+	corrupt := append([]byte{}, data...)
+	corrupt[constants.LOG_ENCRYPTED_HEADER_BYTE_SIZE] ^= 0xff
+	logFile, _ = raw.CreateLog("log-1")
+	logFile.Append(append(corrupt, data...))
+	strict := persistance.NewStoreWithBackend(persistance.NewEncryptedBackend(raw, newTestKeyring(2)))
+	strict.SetStrictRecovery(true)
+	if _, _, _, _, err = strict.InitPersistance(); err == nil {
+		t.Errorf("strict InitPersistance of a corrupt frame => nil;want a recovery error")
+	}
+	if _, ok := err.(*persistance.RecoveryError); !ok || len(strict.LastRecovery().Discarded) != 1 {
+		t.Errorf("strict InitPersistance of a corrupt frame => %v | %+v;want log-1 discarded", err, strict.LastRecovery())
+	}
+}
+
+func TestEncryptedLogOffsets(t *testing.T) {
+	// a log of two frames of a record each
+	raw := persistance.NewMemoryBackend()
+	encrypted := persistance.NewEncryptedBackend(raw, newTestKeyring(1))
+	logFile, _ := encrypted.CreateLog("log-1")
+	persistance.AppendToLogUtil(logFile, structures.Node{Key: structures.NodeID{1}, Domain: "127.0.0.1", Port: 10}, structures.CacheObject{}, 0, 0)
+	first, _ := readFile(raw, persistance.LOG, "log-1")
+	persistance.AppendToLogUtil(logFile, structures.Node{Key: structures.NodeID{2}, Domain: "127.0.0.1", Port: 20}, structures.CacheObject{}, 0, 1)
+	logFile.Close()
+	data, _ := readFile(raw, persistance.LOG, "log-1")
+	second := data[len(first):]
+	corrupt := append([]byte{}, first...)
+	corrupt[constants.LOG_ENCRYPTED_HEADER_BYTE_SIZE] ^= 0xff
+
+	// offsets and sizes are those of the frames as written, not of the decrypted records
+	var tests = []struct {
+		name      string
+		log       []byte
+		records   int
+		truncated int64
+		err       string
+		scanErr   string
+	}{
+		{"whole log", data, 2, 0, "<nil>", "<nil>"},
+		{"torn second frame", append(append([]byte{}, first...), second[:len(second)-5]...), 1, int64(len(second) - 5),
+			"<nil>", fmt.Sprintf("encrypted frame at byte %d is torn", len(first))},
+		{"corrupt first frame", append(corrupt, second...), 0, 0,
+			persistance.ErrCorruptRecord.Error() + ": encrypted frame at byte 0 is corrupt", "encrypted frame at byte 0 is corrupt"},
+	}
+	ends := []int{0, len(first), len(data)}
+	for _, test := range tests {
+		logFile, _ = raw.CreateLog("log-1")
+		logFile.Append(test.log)
+		logFile.Close()
+		file, err := encrypted.Open(persistance.LOG, "log-1")
+		if err != nil {
+			t.Fatalf("%s: Open => %v", test.name, err)
+		}
+
+		var dht structures.DHT
+		truncated, err := persistance.FlushLog(&dht, &structures.Cache{}, file)
+		if len(dht.Lists[0]) != test.records || truncated != test.truncated || fmt.Sprint(err) != test.err {
+			t.Errorf("%s: FlushLog => %d records, %d bytes truncated | (ERROR)= %v;want %d, %d, %s",
+				test.name, len(dht.Lists[0]), truncated, err, test.records, test.truncated, test.err)
+		}
+
+		var offsets []int64
+		records, size, invalid, err := persistance.ScanLog(file, func(offset int64, record *pb.LogNode) {
+			offsets = append(offsets, offset)
+		})
+		file.Close()
+		wantOffsets := fmt.Sprint([]int{0, len(first)}[:test.records])
+		if records != test.records || fmt.Sprint(offsets) != wantOffsets || fmt.Sprint(err) != test.scanErr {
+			t.Errorf("%s: ScanLog => %d records at %v | (ERROR)= %v;want %d at %s, %s", test.name, records, offsets, err, test.records, wantOffsets, test.scanErr)
+		}
+		if wantInvalid := len(test.log) - ends[test.records]; size != int64(len(test.log)) || invalid != int64(wantInvalid) {
+			t.Errorf("%s: ScanLog => %d bytes, %d invalid;want %d, %d", test.name, size, invalid, len(test.log), wantInvalid)
+		}
+	}
+}
+
+// countingLog counts the bytes read from the log it wraps
+type countingLog struct {
+	persistance.LogFile
+	read int64
+}
+
+func (l *countingLog) Read(p []byte) (int, error) {
+	n, err := l.LogFile.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+// countingBackend wraps the logs it creates in a countingLog
+type countingBackend struct {
+	persistance.Backend
+	logs []*countingLog
+}
+
+func (b *countingBackend) CreateLog(name string) (persistance.LogFile, error) {
+	log, err := b.Backend.CreateLog(name)
+	if err != nil {
+		return nil, err
+	}
+	counting := &countingLog{LogFile: log}
+	b.logs = append(b.logs, counting)
+	return counting, nil
+}
+
+func TestEncryptedLogReads(t *testing.T) {
+	raw := &countingBackend{Backend: persistance.NewMemoryBackend()}
+	store := persistance.NewStoreWithBackend(persistance.NewEncryptedBackend(raw, newTestKeyring(1)))
+	_, _, logFile, _, err := store.InitPersistance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.ClosePersistance()
+	for i := 0; i < 10; i++ {
+		store.AppendToLog(structures.Node{Key: structures.NodeID{byte(i)}, Domain: "127.0.0.1", Port: 10}, structures.CacheObject{}, 0, int32(i))
+	}
+
+	// the log bytes are those written, sealing adds to the records
+	wrapped := raw.logs[len(raw.logs)-1]
+	size, _ := wrapped.Seek(0, io.SeekEnd)
+	if stats := store.Stats(); stats.LogBytes != size {
+		t.Errorf("Stats => %d log bytes;want the %d bytes of the encrypted log", stats.LogBytes, size)
+	}
+
+	// a replay decrypts the wrapped log once, not once for every record read
+	wrapped.read = 0
+	var dht structures.DHT
+	persistance.FlushLog(&dht, &structures.Cache{}, logFile)
+	if len(dht.Lists[0]) != 10 || wrapped.read != size {
+		t.Errorf("FlushLog => %d records, read %d bytes of the encrypted log;want 10 records and its %d bytes read once", len(dht.Lists[0]), wrapped.read, size)
+	}
+
+	// the next replay only decrypts what was appended since
+	store.AppendToLog(structures.Node{Key: structures.NodeID{10}, Domain: "127.0.0.1", Port: 10}, structures.CacheObject{}, 0, 10)
+	grown, _ := wrapped.Seek(0, io.SeekEnd)
+	wrapped.read = 0
+	dht = structures.DHT{}
+	persistance.FlushLog(&dht, &structures.Cache{}, logFile)
+	if len(dht.Lists[0]) != 11 || wrapped.read != grown-size {
+		t.Errorf("FlushLog after an append => %d records, read %d bytes of the encrypted log;want 11 records and the %d bytes appended", len(dht.Lists[0]), wrapped.read, grown-size)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydra-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := fmt.Sprintf("%x", bytes.Repeat([]byte{7}, 32))
+	var tests = []struct {
+		contents string
+		valid    bool
+	}{
+		{"# rotated monthly\n1 " + key + "\n\n2 " + key[:32] + "\n", true},
+		{"", false},
+		{"1 " + key + "\n1 " + key + "\n", false},
+		{"1 " + key[:30] + "\n", false},
+		{"one " + key + "\n", false},
+		{key + "\n", false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, "keys")
+		ioutil.WriteFile(path, []byte(test.contents), 0600)
+		_, err := persistance.LoadKeyring(path)
+		if (err == nil) != test.valid {
+			t.Errorf("LoadKeyring(%q) => %v;want valid %v", test.contents, err, test.valid)
+		}
+	}
 }
 
-func cleanUpDHTs() {
-	dhtFiles := persistance.GetPersistanceFileNames(persistance.DHT)
+func cleanUpDHTs(store *persistance.Store, backend persistance.Backend) {
+	dhtFiles := store.GetPersistanceFileNames(persistance.DHT)
 
 	for _, d := range dhtFiles {
-		os.Remove("dht/" + d.Name())
+		backend.Delete(persistance.DHT, d)
 	}
 }
 
-func cleanUpDHTsBut(filename string) {
-	dhtFiles := persistance.GetPersistanceFileNames(persistance.DHT)
+func cleanUpDHTsBut(store *persistance.Store, backend persistance.Backend, filename string) {
+	dhtFiles := store.GetPersistanceFileNames(persistance.DHT)
 
 	for _, d := range dhtFiles {
-		if filename != d.Name() {
-			os.Remove("dht/" + d.Name())
+		if filename != d {
+			backend.Delete(persistance.DHT, d)
 		}
 	}
 }
 
-func cleanUpLogs() {
-	logFiles := persistance.GetPersistanceFileNames(persistance.LOG)
+func cleanUpLogs(store *persistance.Store, backend persistance.Backend) {
+	logFiles := store.GetPersistanceFileNames(persistance.LOG)
 	for _, l := range logFiles {
-		os.Remove("log/" + l.Name())
+		backend.Delete(persistance.LOG, l)
 	}
 }
@@ -0,0 +1,124 @@
+package persistance
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrLogNotCompatible is the reason a log is discarded when it doesn't follow the
+// dht file or log it would be replayed after
+var ErrLogNotCompatible = errors.New("log doesn't follow the dht it would be replayed onto")
+
+// DiscardedFile is a log or dht file that recovery couldn't use, along with the reason
+type DiscardedFile struct {
+	Name   string
+	Reason error
+}
+
+/*
+RecoveryReport describes how RecoverDHT recovered the DHT, so that an operator can
+tell whether anything was lost.
+
+A torn record at the end of the latest log is expected after a crash, it was never
+acknowledged as synced, so it is only counted in TruncatedBytes. Everything else
+recovery couldn't use is listed in Discarded.
+*/
+type RecoveryReport struct {
+	// Snapshot is the dht file the DHT was loaded from, empty if it was rebuilt from
+	// the logs alone
+	Snapshot string
+	// LogsReplayed are the log files replayed onto the snapshot, oldest first
+	LogsReplayed []string
+	// RecordsApplied is the number of log records replayed
+	RecordsApplied int
+	// TruncatedBytes is the number of bytes of invalid records at the end of the logs
+	TruncatedBytes int64
+	// Discarded are the files left out of the recovered DHT
+	Discarded []DiscardedFile
+	// Skipped are the dht files that couldn't be read, but which the recovered DHT
+	// is newer than. They point to a faulty disk rather than to lost data.
+	Skipped []DiscardedFile
+
+	// unreadable are the dht files that couldn't be read, till it is known
+	// whether they are discarded or skipped
+	unreadable []DiscardedFile
+}
+
+// discard records that the file was left out of the recovered DHT
+func (r *RecoveryReport) discard(name string, reason error) {
+	r.Discarded = append(r.Discarded, DiscardedFile{Name: name, Reason: reason})
+}
+
+// snapshotUnreadable records that the dht file couldn't be read
+func (r *RecoveryReport) snapshotUnreadable(name string, reason error) {
+	r.unreadable = append(r.unreadable, DiscardedFile{Name: name, Reason: reason})
+}
+
+// resolveSnapshots sorts the unreadable dht files into skipped and discarded ones,
+// once the DHT is recovered upto the index reached. A dht file is only skipped if the
+// DHT was recovered from an older dht file and the logs after it.
+func (r *RecoveryReport) resolveSnapshots(reached int64) {
+	for _, f := range r.unreadable {
+		index, err := GetFileIndex(f.Name, DHT)
+		if r.Snapshot != "" && err == nil && index <= reached {
+			r.Skipped = append(r.Skipped, f)
+		} else {
+			r.Discarded = append(r.Discarded, f)
+		}
+	}
+	r.unreadable = nil
+}
+
+// KeyError is returned by recovery when a file can't be read with the keys at hand,
+// strict or not. The file isn't corrupt, so recovery stops without touching any file
+// and a restart with the right key file recovers it.
+type KeyError struct {
+	Name string
+	Err  error
+}
+
+// implements the error for the key error
+func (e *KeyError) Error() string {
+	return e.Name + ": " + e.Err.Error()
+}
+
+// keyError returns a *KeyError if err means the file called name needs other keys, else nil
+func keyError(name string, err error) error {
+	if err == ErrEncrypted || err == ErrUnknownKey || err == ErrDecrypt {
+		return &KeyError{Name: name, Err: err}
+	}
+	return nil
+}
+
+// RecoveryError is returned by a strict recovery instead of discarding files
+type RecoveryError struct {
+	Report RecoveryReport
+}
+
+// implements the error for the recovery error
+func (e *RecoveryError) Error() string {
+	var files []string
+	for _, f := range e.Report.Discarded {
+		files = append(files, fmt.Sprintf("%s (%v)", f.Name, f.Reason))
+	}
+	return "strict recovery refused to discard " + strings.Join(files, ", ")
+}
+
+/*
+SetStrictRecovery sets whether recovery refuses to discard files. A strict recovery
+returns a RecoveryError and leaves every file untouched instead of leaving a file it
+can't use out of the recovered DHT. A torn record at the end of the latest log is
+still truncated, read documentation of RecoveryReport.
+
+Arguments:
+1. strict: true to refuse to discard files, false by default
+*/
+func (s *Store) SetStrictRecovery(strict bool) {
+	s.strictRecovery = strict
+}
+
+// LastRecovery returns the report of the recovery done by the last InitPersistance
+func (s *Store) LastRecovery() RecoveryReport {
+	return s.recovery
+}
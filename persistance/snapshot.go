@@ -0,0 +1,174 @@
+package persistance
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hydra-dht/constants"
+	pb "hydra-dht/protobuf/node"
+	"hydra-dht/structures"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// snapshotMagic starts every protobuf dht file, legacy gob dht files don't have it
+var snapshotMagic = []byte("HDHT")
+
+// ErrSnapshotVersion is returned when a dht file is of a newer format than this build reads
+var ErrSnapshotVersion = errors.New("dht file has unknown snapshot format version")
+
+// HeaderError is returned when a dht file was written by another node, or with another
+// bucket size, than the one set by SetSnapshotHeader. Its buckets don't fit the DHT of
+// the node, so recovery stops without touching any file, strict or not.
+type HeaderError struct {
+	Name       string
+	NodeID     structures.NodeID
+	BucketSize int
+	// WantNodeID and WantBucketSize are the details set by SetSnapshotHeader
+	WantNodeID     structures.NodeID
+	WantBucketSize int
+}
+
+// implements the error for the header error
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("%s: dht file is of node %s with bucket size %d, not of node %s with bucket size %d",
+		e.Name, e.NodeID.Hex(), e.BucketSize, e.WantNodeID.Hex(), e.WantBucketSize)
+}
+
+/*
+SetSnapshotHeader sets the details of the node that are written into the header
+of every snapshot. Once set, dht files with other details in their header
+can't be loaded, read documentation of HeaderError.
+
+Arguments:
+1. nodeID: Key of the node owning the DHT
+2. bucketSize: Max number of nodes in a bucket of the DHT
+*/
+func (s *Store) SetSnapshotHeader(nodeID structures.NodeID, bucketSize int) {
+	s.nodeID = nodeID
+	s.bucketSize = bucketSize
+}
+
+// SetSnapshotHeader sets the snapshot header details of the default store
+func SetSnapshotHeader(nodeID structures.NodeID, bucketSize int) {
+	defaultStore.SetSnapshotHeader(nodeID, bucketSize)
+}
+
+/*
+encodeSnapshot encodes the dht along with its cache into the snapshot format of dht files. It is the
+snapshotMagic followed by a DHTSnapshot protobuf, so the files can be read from
+any language. Please check the proto DHTSnapshot defination for the layout.
+*/
+func (s *Store) encodeSnapshot(dht *structures.DHT, cache *structures.Cache) ([]byte, error) {
+	snapshot := &pb.DHTSnapshot{
+		Header: &pb.SnapshotHeader{
+			FormatVersion: constants.SNAPSHOT_FORMAT_VERSION,
+			NodeId:        s.nodeID[:],
+			BucketSize:    int32(s.bucketSize),
+			Timestamp:     time.Now().UnixNano(),
+		},
+	}
+
+	for row := 0; row < constants.HASH_SIZE; row++ {
+		if len(dht.Lists[row]) == 0 {
+			continue
+		}
+		bucket := &pb.Bucket{Index: int32(row)}
+		for i := range dht.Lists[row] {
+			n := dht.Lists[row][i]
+			bucket.Entries = append(bucket.Entries, &pb.BucketEntry{
+				Node: &pb.Node{
+					NodeId: n.Key[:],
+					Domain: n.Domain,
+					Port:   int32(n.Port),
+				},
+				Cache: toCacheEntry(cacheObjectAt(cache, row, i)),
+			})
+		}
+		snapshot.Buckets = append(snapshot.Buckets, bucket)
+	}
+
+	out, err := proto.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, snapshotMagic...), out...), nil
+}
+
+// cacheObjectAt returns the cache entry of the node at col of the row, never seen if the cache has none
+func cacheObjectAt(cache *structures.Cache, row int, col int) structures.CacheObject {
+	if cache == nil || col >= len(cache.Lists[row]) {
+		return structures.CacheObject{}
+	}
+	return cache.Lists[row][col]
+}
+
+// decodeSnapshot decodes a snapshot written by encodeSnapshot back into a dht and its cache
+func (s *Store) decodeSnapshot(data []byte) (*structures.DHT, *structures.Cache, error) {
+	snapshot := &pb.DHTSnapshot{}
+	err := proto.Unmarshal(data[len(snapshotMagic):], snapshot)
+	if err != nil {
+		return nil, nil, err
+	}
+	if snapshot.GetHeader().GetFormatVersion() > constants.SNAPSHOT_FORMAT_VERSION {
+		return nil, nil, ErrSnapshotVersion
+	}
+	if err := s.checkSnapshotHeader(snapshot.GetHeader()); err != nil {
+		return nil, nil, err
+	}
+
+	dht := &structures.DHT{}
+	cache := &structures.Cache{}
+	for _, bucket := range snapshot.Buckets {
+		if bucket.Index < 0 || bucket.Index >= constants.HASH_SIZE {
+			return nil, nil, fmt.Errorf("dht file has illegal bucket index %d", bucket.Index)
+		}
+		for _, entry := range bucket.Entries {
+			var key structures.NodeID
+			copy(key[:], entry.GetNode().GetNodeId())
+			dht.Lists[bucket.Index] = append(dht.Lists[bucket.Index], structures.Node{
+				Key:    key,
+				Domain: entry.GetNode().GetDomain(),
+				Port:   int(entry.GetNode().GetPort()),
+			})
+			cache.Lists[bucket.Index] = append(cache.Lists[bucket.Index], toCacheObject(entry.GetCache()))
+		}
+	}
+	return dht, cache, nil
+}
+
+// checkSnapshotHeader checks the header of a snapshot against the details set by
+// SetSnapshotHeader. Stores without them, and snapshots written by such stores, accept any.
+func (s *Store) checkSnapshotHeader(header *pb.SnapshotHeader) error {
+	var nodeID structures.NodeID
+	copy(nodeID[:], header.GetNodeId())
+	bucketSize := int(header.GetBucketSize())
+	if s.bucketSize == 0 || bucketSize == 0 {
+		return nil
+	}
+	if nodeID != s.nodeID || bucketSize != s.bucketSize {
+		return &HeaderError{NodeID: nodeID, BucketSize: bucketSize, WantNodeID: s.nodeID, WantBucketSize: s.bucketSize}
+	}
+	return nil
+}
+
+// decodeDHTFile decodes the contents of a dht file, either a snapshot or a legacy gob.
+// Legacy gobs have no cache, their nodes are given never seen cache entries.
+func (s *Store) decodeDHTFile(data []byte) (*structures.DHT, *structures.Cache, error) {
+	if bytes.HasPrefix(data, snapshotMagic) {
+		return s.decodeSnapshot(data)
+	}
+	if bytes.HasPrefix(data, encryptedSnapshotMagic) {
+		return &structures.DHT{}, &structures.Cache{}, ErrEncrypted
+	}
+
+	dht := &structures.DHT{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(dht)
+	cache := &structures.Cache{}
+	for row := range dht.Lists {
+		cache.Lists[row] = make([]structures.CacheObject, len(dht.Lists[row]))
+	}
+	return dht, cache, err
+}
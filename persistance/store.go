@@ -0,0 +1,109 @@
+package persistance
+
+import (
+	"hydra-dht/constants"
+	"hydra-dht/structures"
+	"sync"
+	"time"
+)
+
+/*
+Store keeps the logs and dht snapshots of a DHT in a Backend. NewStore keeps them
+in the log and dht folders of a data directory, so several nodes on one host can
+each be given their own.
+
+The package level functions work on a default store rooted at the working directory.
+*/
+type Store struct {
+	backend      Backend
+	logFile      LogFile
+	filePosition int64
+	logIndex     int
+
+	// writer group commits the appends to logFile
+	writer        *logWriter
+	commitLatency time.Duration
+
+	// strictRecovery refuses to discard files in recovery, recovery reports the last one
+	strictRecovery bool
+	recovery       RecoveryReport
+
+	// details of the node written into the header of every snapshot
+	nodeID     structures.NodeID
+	bucketSize int
+
+	// statsLock guards the statistics and compaction policy, which are read
+	// outside of the lock of the DHT
+	statsLock     sync.Mutex
+	stats         Stats
+	maxLogRecords int
+	maxLogBytes   int64
+	compact       chan struct{}
+}
+
+// defaultStore backs the package level functions
+var defaultStore = NewStoreWithBackend(&fileBackend{dir: "."})
+
+/*
+NewStore creates a store keeping its files in the data directory dir. The data
+directory along with its log and dht folders is created if it doesn't exist, so a
+fresh directory is set up on the first run.
+
+Arguments:
+1. dir: The data directory
+Returns:
+1. *Store: The store
+2. error: Error in creating the directory layout, nil if no error
+*/
+func NewStore(dir string) (*Store, error) {
+	backend, err := NewFileBackend(dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewStoreWithBackend(backend), nil
+}
+
+/*
+NewStoreWithBackend creates a store keeping its files in the backend. The backend is
+owned by the caller, who closes it once done with the store.
+
+Arguments:
+1. backend: The backend the files are kept in
+Returns:
+1. *Store: The store
+*/
+func NewStoreWithBackend(backend Backend) *Store {
+	return &Store{
+		backend:       backend,
+		logIndex:      1,
+		commitLatency: constants.LOG_COMMIT_LATENCY,
+		maxLogRecords: constants.COMPACT_LOG_RECORDS,
+		maxLogBytes:   constants.COMPACT_LOG_BYTES,
+		compact:       make(chan struct{}, 1),
+	}
+}
+
+/*
+SetCommitLatency sets the max time a log append waits for other appends to share its
+write and fsync. A longer latency batches more appends on slow disks. It takes effect
+from the next log file opened.
+
+Arguments:
+1. latency: The max commit latency, LOG_COMMIT_LATENCY by default
+*/
+func (s *Store) SetCommitLatency(latency time.Duration) {
+	s.commitLatency = latency
+}
+
+// Open opens the file called name of fileType in the backend of the store for reading
+func (s *Store) Open(fileType PERSISTANCE_FILE, name string) (ReadSeekCloser, error) {
+	return s.backend.Open(fileType, name)
+}
+
+// stopWriter writes the appends queued for the log file and stops its writer
+func (s *Store) stopWriter() {
+	if s.writer != nil {
+		s.writer.stop()
+		s.writer = nil
+	}
+}
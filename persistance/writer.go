@@ -0,0 +1,99 @@
+package persistance
+
+import (
+	"hydra-dht/constants"
+	"time"
+)
+
+// logRequest is a record waiting to be appended to the log, flushed receives the
+// result once the record is synced to disk
+type logRequest struct {
+	record  []byte
+	flushed chan error
+}
+
+/*
+logWriter does group commit for the log. Records appended concurrently are
+coalesced into a single write and fsync, instead of each record paying for its
+own fsync. The first record of a batch waits upto maxLatency for others to join
+it. Records are written in the order they are appended.
+*/
+type logWriter struct {
+	file       LogFile
+	maxLatency time.Duration
+	written    func(size int)
+	requests   chan logRequest
+	done       chan struct{}
+}
+
+// newLogWriter starts a log writer appending to file, written is called with the
+// number of bytes every batch took on disk before its records are reported flushed
+func newLogWriter(file LogFile, maxLatency time.Duration, written func(size int)) *logWriter {
+	w := &logWriter{
+		file:       file,
+		maxLatency: maxLatency,
+		written:    written,
+		requests:   make(chan logRequest, constants.LOG_MAX_BATCH_SIZE),
+		done:       make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// append queues the record to be written, the returned channel receives the
+// result once it is synced to disk
+func (w *logWriter) append(record []byte) <-chan error {
+	flushed := make(chan error, 1)
+	w.requests <- logRequest{record: record, flushed: flushed}
+	return flushed
+}
+
+// stop writes the records already queued and stops the writer. The file is left open.
+func (w *logWriter) stop() {
+	close(w.requests)
+	<-w.done
+}
+
+func (w *logWriter) run() {
+	defer close(w.done)
+
+	for request := range w.requests {
+		batch := []logRequest{request}
+		open := true
+		timer := time.NewTimer(w.maxLatency)
+	collect:
+		for len(batch) < constants.LOG_MAX_BATCH_SIZE {
+			select {
+			case request, open = <-w.requests:
+				if !open {
+					break collect
+				}
+				batch = append(batch, request)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		w.commit(batch)
+		if !open {
+			return
+		}
+	}
+}
+
+// commit writes the batch of records in a single append, a single write followed by a single fsync
+func (w *logWriter) commit(batch []logRequest) {
+	var out []byte
+	for _, request := range batch {
+		out = append(out, request.record...)
+	}
+
+	err := w.file.Append(out)
+	if err == nil {
+		w.written(appendedSize(w.file, len(out)))
+	}
+	for _, request := range batch {
+		request.flushed <- err
+	}
+}
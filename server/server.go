@@ -3,58 +3,154 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
+	"hydra-dht/constants"
 	dhtUtil "hydra-dht/dht"
+	"hydra-dht/nodedetails"
+	"hydra-dht/persistance"
 	pb "hydra-dht/protobuf/node"
-	"io/ioutil"
+	"hydra-dht/structures"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/fatih/color"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
 	nodePort   = flag.Int("port", 10000, "The server port")
-	jsonDBFile = flag.String("json_db_file", "../testdata/closest_nodes.json", "A json file containing a list of features")
+	nodeDomain = flag.String("domain", "127.0.0.1", "The domain other nodes reach this node at")
+	dataDir    = flag.String("data-dir", "data", "The directory the node id and routing table are persisted in, created on first start")
+	storage    = flag.String("storage", "file", "The storage backend the routing table is persisted in, file or bolt")
+	nodeIDFile = flag.String("node-id-file", "", "The file the node id is persisted in, generated on first start. Defaults to node-id in the data dir")
+	bootstrap  = flag.String("bootstrap", "", "Comma separated list of seed nodes in host:port format to join the network through")
+	seedTable  = flag.String("seed-table", "", "A routing table exported to JSON to seed the routing table with on start")
+	keyFile    = flag.String("key-file", "", "The key file to encrypt the persisted routing table with, read persistance.LoadKeyring for its format. Not encrypted if empty")
+	strict     = flag.Bool("strict-recovery", false, "Refuse to start instead of discarding persisted files the routing table can't be recovered from")
 )
 
 // NodeServer is the stub for DHT
 type NodeServer struct {
-	savedNodes *pb.CloserNodes
+	values *valueStore
+	rt     *dhtUtil.RoutingTable
 }
 
-// FindNodes finds closest nodes and returns the results
-func (s *NodeServer) FindNodes(ctx context.Context, node *pb.Node) (*pb.CloserNodes, error) {
-	// No feature was found,  returns an unnamed feature
-	return &pb.CloserNodes{Nodes: s.savedNodes.Nodes}, nil
+// FindNodes finds the K closest live nodes in the DHT to the requested target
+func (s *NodeServer) FindNodes(ctx context.Context, request *pb.FindNodesRequest) (*pb.CloserNodes, error) {
+	if len(request.Target) != constants.NUM_BYTES {
+		return nil, status.Errorf(codes.InvalidArgument, "Illegal target length %d, keys are %d bytes", len(request.Target), constants.NUM_BYTES)
+	}
+	var key structures.NodeID
+	copy(key[:], request.Target)
+
+	closest := s.rt.FindClosestNodes(key, constants.K_BUCKET_SIZE)
+	return &pb.CloserNodes{Nodes: toPbNodes(closest)}, nil
 }
 
-// Ping checks whether the node is lively or not
-func (s *NodeServer) Ping(ctx context.Context, node *pb.Node) (*pb.PingResponse, error) {
-	fmt.Printf("I got a Ping from machine : %v:%d \n", node.Domain, node.Port)
-	return &pb.PingResponse{Alive: true}, nil
+// Store saves the key value pair in the node's local value store, it isn't stored if the store is full.
+// Values are kept for at most constants.MAX_VALUE_TTL.
+func (s *NodeServer) Store(ctx context.Context, request *pb.StoreRequest) (*pb.StoreResponse, error) {
+	if len(request.Key) != constants.NUM_BYTES {
+		return nil, status.Errorf(codes.InvalidArgument, "Illegal key length %d, keys are %d bytes", len(request.Key), constants.NUM_BYTES)
+	}
+	if request.Ttl <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Illegal ttl %d, values are stored for a positive number of seconds", request.Ttl)
+	}
+	if len(request.Value) > constants.MAX_VALUE_SIZE {
+		return nil, status.Errorf(codes.InvalidArgument, "Illegal value size %d, values are upto %d bytes", len(request.Value), constants.MAX_VALUE_SIZE)
+	}
+	var key structures.NodeID
+	copy(key[:], request.Key)
+
+	// clamped before converting, a ttl of as many seconds may not fit a time.Duration
+	ttl := constants.MAX_VALUE_TTL
+	if request.Ttl < int64(constants.MAX_VALUE_TTL/time.Second) {
+		ttl = time.Duration(request.Ttl) * time.Second
+	}
+	stored := s.values.put(key, request.Value, ttl)
+	return &pb.StoreResponse{Stored: stored}, nil
 }
 
-// loadFeatures loads features from a JSON file.
-func (s *NodeServer) loadFeatures(filePath string) {
-	file, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		log.Fatalf("Failed to load default features: %v", err)
+// FindValue returns the value of the key if stored locally, else the K closest live nodes to the key
+func (s *NodeServer) FindValue(ctx context.Context, request *pb.FindValueRequest) (*pb.FindValueResponse, error) {
+	if len(request.Key) != constants.NUM_BYTES {
+		return nil, status.Errorf(codes.InvalidArgument, "Illegal key length %d, keys are %d bytes", len(request.Key), constants.NUM_BYTES)
+	}
+	var key structures.NodeID
+	copy(key[:], request.Key)
+
+	if value, ok := s.values.get(key); ok {
+		return &pb.FindValueResponse{Found: true, Value: value}, nil
+	}
+
+	closest := s.rt.FindClosestNodes(key, constants.K_BUCKET_SIZE)
+	return &pb.FindValueResponse{Found: false, CloserNodes: toPbNodes(closest)}, nil
+}
+
+// senderRequest is implemented by every request that carries the node sending it
+type senderRequest interface {
+	GetSender() *pb.Node
+}
+
+// learnPeers is a unary interceptor that feeds the sender of every incoming request
+// into the routing table, keeping it warm without any extra traffic.
+func (s *NodeServer) learnPeers(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	switch r := request.(type) {
+	case *pb.Node:
+		s.learnPeer(r)
+	case senderRequest:
+		s.learnPeer(r.GetSender())
+	}
+	return handler(ctx, request)
+}
+
+// learnPeer adds the node that sent a request into the DHT. The response is
+// drained in the background as the row listener may have to ping the bucket first.
+func (s *NodeServer) learnPeer(sender *pb.Node) {
+	if sender == nil || len(sender.NodeId) != constants.NUM_BYTES {
+		return
+	}
+	var key structures.NodeID
+	copy(key[:], sender.NodeId)
+	if key == nodedetails.MyNode.Key {
+		return
 	}
-	if err := json.Unmarshal(file, &s.savedNodes); err != nil {
-		log.Fatalf("Failed to load default features: %v", err)
+
+	channel := s.rt.AddNodeWithID(sender.Domain, int(sender.Port), key)
+	go func() {
+		<-channel
+	}()
+}
+
+// toPbNodes converts DHT nodes to protobuf nodes for sending over the wire
+func toPbNodes(nodes []structures.Node) []*pb.Node {
+	var pbNodes []*pb.Node
+	for i := range nodes {
+		pbNodes = append(pbNodes, &pb.Node{
+			NodeId: nodes[i].Key[:],
+			Domain: nodes[i].Domain,
+			Port:   int32(nodes[i].Port),
+		})
 	}
+	return pbNodes
+}
+
+// Ping checks whether the node is lively or not
+func (s *NodeServer) Ping(ctx context.Context, node *pb.Node) (*pb.PingResponse, error) {
+	fmt.Printf("I got a Ping from machine : %v:%d \n", node.Domain, node.Port)
+	return &pb.PingResponse{Alive: true, Node: toPbNodes([]structures.Node{*nodedetails.MyNode})[0]}, nil
 }
 
-// Returns the server data structure with stub data
-func getDataStructure() *NodeServer {
-	s := &NodeServer{}
+// Returns the server data structure backed by the routing table
+func getDataStructure(rt *dhtUtil.RoutingTable) *NodeServer {
+	s := &NodeServer{values: newValueStore(), rt: rt}
 	return s
 }
 
@@ -65,34 +161,91 @@ StartServer starts up the server for node and takes in
 3. Number of bits for node key
 4. Timeout seconds for ping response
 */
-func StartServer() {
-	flag.Parse()
+func StartServer(rt *dhtUtil.RoutingTable) {
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *nodePort))
 	color.Red("Server listening at port : %d", *nodePort)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	grpcServer := grpc.NewServer()
-	pb.RegisterNodeDiscoveryServer(grpcServer, getDataStructure())
+	nodeServer := getDataStructure(rt)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(nodeServer.learnPeers))
+	pb.RegisterNodeDiscoveryServer(grpcServer, nodeServer)
 	// determine whether to use tls
 
-	// time out for cache is 1 hour
-	dhtUtil.InitDHT(2, 60)
+	if seeds := parseSeeds(*bootstrap); len(seeds) > 0 {
+		go joinNetwork(rt, seeds)
+	}
 
 	grpcServer.Serve(lis)
 
 }
 
+// parseSeeds splits the comma separated bootstrap flag into seed addresses
+func parseSeeds(flagValue string) []string {
+	var seeds []string
+	for _, seed := range strings.Split(flagValue, ",") {
+		seed = strings.TrimSpace(seed)
+		if seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	return seeds
+}
+
+// importTable imports the routing table exported to the JSON file at path
+func importTable(rt *dhtUtil.RoutingTable, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("failed to import routing table: %v", err)
+		return
+	}
+	defer file.Close()
+
+	result, err := rt.ImportJSON(file)
+	if err != nil {
+		log.Printf("failed to import routing table: %v", err)
+		return
+	}
+	color.Yellow("Imported %s: %d nodes added, %d kept as replacements, %d rejected", path, result.Added, result.Replacements, result.Rejected)
+}
+
+// exportTable exports the routing table to the JSON file at path
+func exportTable(rt *dhtUtil.RoutingTable, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = rt.ExportJSON(file)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// joinNetwork joins the network through the seed nodes
+func joinNetwork(rt *dhtUtil.RoutingTable, seeds []string) {
+	color.Yellow("Joining network through %d seed nodes", len(seeds))
+	if err := rt.Join(seeds); err != nil {
+		log.Printf("failed to join network: %v", err)
+		return
+	}
+	color.Yellow("Joined network")
+}
+
 /*
 StartCLI starts up the client CLI, it's functionality includes
 1. Ping to check node of port number x is alive
-2. Find Nodes for key k
+2. Add a node with key k
+3. Remove the node with key k
+4. Export the routing table to a JSON file
+5. Import the nodes of a JSON file into the routing table
 */
-func StartCLI() {
+func StartCLI(rt *dhtUtil.RoutingTable) {
 	for {
 		reader := bufio.NewReader(os.Stdin)
-		color.Green("1. Ping a Node \n2. Add a Node Into HashTable")
+		color.Green("1. Ping a Node \n2. Add a Node Into HashTable\n3. Remove a Node From HashTable\n4. Export HashTable To JSON\n5. Import HashTable From JSON")
 		color.Blue("Enter an option: ")
 		option, _ := reader.ReadString('\n')
 		option = strings.TrimSpace(option)
@@ -113,11 +266,16 @@ func StartCLI() {
 
 		case "2":
 			color.Blue("You selected Add Node option")
-			color.Blue("Enter the node key ")
+			color.Blue("Enter the node key in hex ")
 			nodeId, _ := reader.ReadString('\n')
 			nodeId = strings.TrimSpace(nodeId)
 
-			channel, _ := dhtUtil.AddNode("127.0.0.1", 80, nodeId)
+			key, err := structures.ParseNodeIDHex(nodeId)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			channel := rt.AddNodeWithID("127.0.0.1", 80, key)
 
 			select {
 			case actual := <-channel:
@@ -127,11 +285,114 @@ func StartCLI() {
 			case <-time.After(time.Second * 1):
 				fmt.Println("Time Out error")
 			}
+
+		case "3":
+			color.Blue("You selected Remove Node option")
+			color.Blue("Enter the node key in hex ")
+			nodeId, _ := reader.ReadString('\n')
+			nodeId = strings.TrimSpace(nodeId)
+
+			key, err := structures.ParseNodeIDHex(nodeId)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			channel := rt.RemoveNode(key)
+
+			select {
+			case actual := <-channel:
+				fmt.Println(actual.ListIndex)
+				fmt.Println(actual.Removed)
+			case <-time.After(time.Second * 1):
+				fmt.Println("Time Out error")
+			}
+
+		case "4":
+			color.Blue("You selected Export option")
+			color.Blue("Enter the file to export to ")
+			path, _ := reader.ReadString('\n')
+			path = strings.TrimSpace(path)
+
+			if err := exportTable(rt, path); err != nil {
+				fmt.Println(err)
+			}
+
+		case "5":
+			color.Blue("You selected Import option")
+			color.Blue("Enter the file to import from ")
+			path, _ := reader.ReadString('\n')
+			path = strings.TrimSpace(path)
+
+			importTable(rt, path)
+		}
+	}
+}
+
+// openBackend opens the storage backend of the given kind in the data dir, encrypted
+// with the keys of the key file if one is given
+func openBackend(kind string, dir string, keyFile string) (persistance.Backend, error) {
+	var keys *persistance.Keyring
+	if keyFile != "" {
+		var err error
+		keys, err = persistance.LoadKeyring(keyFile)
+		if err != nil {
+			return nil, err
 		}
 	}
+
+	var backend persistance.Backend
+	var err error
+	switch kind {
+	case "file":
+		backend, err = persistance.NewFileBackend(dir)
+	case "bolt":
+		backend, err = persistance.NewBoltBackend(filepath.Join(dir, "hydra.db"))
+	default:
+		err = fmt.Errorf("unknown storage backend %q, use file or bolt", kind)
+	}
+	if err != nil || keys == nil {
+		return backend, err
+	}
+	return persistance.NewEncryptedBackend(backend, keys), nil
 }
 
 func main() {
-	go StartServer()
-	StartCLI()
+	flag.Parse()
+	if err := os.MkdirAll(*dataDir, 0755); err != nil {
+		log.Fatalf("failed to create data dir: %v", err)
+	}
+	idFile := *nodeIDFile
+	if idFile == "" {
+		idFile = filepath.Join(*dataDir, "node-id")
+	}
+	if err := nodedetails.InitMyNode(idFile, *nodeDomain, *nodePort); err != nil {
+		log.Fatalf("failed to set up node identity: %v", err)
+	}
+	color.Red("Node id : %x", nodedetails.MyNode.Key)
+
+	backend, err := openBackend(*storage, *dataDir, *keyFile)
+	if err != nil {
+		log.Fatalf("failed to open storage: %v", err)
+	}
+	defer backend.Close()
+
+	// time out for cache is 1 hour
+	rt, err := dhtUtil.New(nodedetails.MyNode.Key, dhtUtil.Options{
+		BucketSize:         2,
+		CacheExpiryMinutes: 60,
+		Domain:             nodedetails.MyNode.Domain,
+		Port:               nodedetails.MyNode.Port,
+		Backend:            backend,
+		StrictRecovery:     *strict,
+	})
+	if err != nil {
+		log.Fatalf("failed to recover DHT: %v", err)
+	}
+	defer rt.Close()
+
+	if *seedTable != "" {
+		go importTable(rt, *seedTable)
+	}
+	go StartServer(rt)
+	StartCLI(rt)
 }
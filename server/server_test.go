@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hydra-dht/constants"
+	dhtUtil "hydra-dht/dht"
+	"hydra-dht/nodedetails"
+	pb "hydra-dht/protobuf/node"
+	"hydra-dht/structures"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseSeeds(t *testing.T) {
+	var tests = []struct {
+		flag  string
+		seeds string
+	}{
+		{"", "[]"},
+		{"127.0.0.1:10000", "[127.0.0.1:10000]"},
+		{"127.0.0.1:10000,node.example:10001", "[127.0.0.1:10000 node.example:10001]"},
+		// blanks and empty entries are dropped
+		{" 127.0.0.1:10000 , ,node.example:10001 ,", "[127.0.0.1:10000 node.example:10001]"},
+		{",", "[]"},
+		// IPv6 addresses keep their brackets for net.SplitHostPort
+		{"[::1]:10000", "[[::1]:10000]"},
+	}
+	for _, test := range tests {
+		if seeds := fmt.Sprint(parseSeeds(test.flag)); seeds != test.seeds {
+			t.Errorf("parseSeeds(%q) => %s;want %s", test.flag, seeds, test.seeds)
+		}
+	}
+}
+
+func TestLearnPeers(t *testing.T) {
+	rt, err := dhtUtil.New(nodedetails.MyNode.Key, dhtUtil.Options{BucketSize: 2, CacheExpiryMinutes: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+	s := getDataStructure(rt)
+
+	peer := func(firstByte byte) *pb.Node {
+		key := structures.NodeID{firstByte, 4, 67, 124}
+		return &pb.Node{NodeId: key[:], Domain: "127.0.0.1", Port: int32(firstByte)}
+	}
+	var tests = []struct {
+		name    string
+		request interface{}
+		learned bool
+	}{
+		{"request without sender", &pb.FindValueRequest{}, false},
+		{"sender with a short id", &pb.FindNodesRequest{Sender: &pb.Node{NodeId: []byte{1, 2}}}, false},
+		{"sender claiming to be this node", &pb.StoreRequest{Sender: &pb.Node{NodeId: nodedetails.MyNode.Key[:]}}, false},
+		{"sender of a request", &pb.FindNodesRequest{Sender: peer(0x81)}, true},
+		{"pinging node", peer(0x41), true},
+	}
+	learned := 0
+	for _, test := range tests {
+		called := false
+		handler := func(ctx context.Context, request interface{}) (interface{}, error) {
+			called = true
+			return "response", nil
+		}
+		response, err := s.learnPeers(context.Background(), test.request, &grpc.UnaryServerInfo{}, handler)
+		if !called || response != "response" || err != nil {
+			t.Errorf("%s: learnPeers => %v, %v;want the response of the handler", test.name, response, err)
+		}
+		if test.learned {
+			learned++
+		}
+	}
+
+	// the senders are added in the background
+	deadline := time.Now().Add(time.Second)
+	nodes := rt.FindClosestNodes(structures.NodeID{}, 10)
+	for len(nodes) < learned && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		nodes = rt.FindClosestNodes(structures.NodeID{}, 10)
+	}
+	if len(nodes) != learned {
+		t.Errorf("FindClosestNodes after learnPeers => %v;want the %d senders", nodes, learned)
+	}
+}
+
+func TestFindNodes(t *testing.T) {
+	rt, err := dhtUtil.New(nodedetails.MyNode.Key, dhtUtil.Options{BucketSize: 20, CacheExpiryMinutes: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+	s := getDataStructure(rt)
+	for _, firstByte := range []byte{0x81, 0x21, 0x41} {
+		<-rt.AddNodeWithID("127.0.0.1", int(firstByte), structures.NodeID{firstByte, 4, 67, 124})
+	}
+
+	target := make([]byte, constants.NUM_BYTES)
+	var tests = []struct {
+		name   string
+		target []byte
+	}{
+		{"no target", nil},
+		{"short target", target[:4]},
+		{"long target", append(target, 0)},
+	}
+	for _, test := range tests {
+		if _, err := s.FindNodes(context.Background(), &pb.FindNodesRequest{Target: test.target}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("FindNodes with %s => %v;want an InvalidArgument error", test.name, err)
+		}
+	}
+
+	response, err := s.FindNodes(context.Background(), &pb.FindNodesRequest{Target: target})
+	if err != nil {
+		t.Fatalf("FindNodes => %v", err)
+	}
+	var firstBytes []byte
+	for _, n := range response.Nodes {
+		firstBytes = append(firstBytes, n.NodeId[0])
+	}
+	if fmt.Sprintf("%x", firstBytes) != "214181" {
+		t.Errorf("FindNodes => nodes %x;want 214181, closest to the target first", firstBytes)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"hydra-dht/constants"
+	"hydra-dht/structures"
+	"sync"
+	"time"
+)
+
+// storedValue is a value kept by the node along with the time it expires at
+type storedValue struct {
+	value   []byte
+	expires time.Time
+}
+
+// valueStore is the local key value store of the node, filled by Store requests.
+// It keeps upto constants.MAX_STORED_VALUES values of constants.MAX_STORED_BYTES.
+type valueStore struct {
+	lock   sync.RWMutex
+	values map[structures.NodeID]storedValue
+	bytes  int
+	// nextExpiry is the earliest time a stored value may expire at
+	nextExpiry time.Time
+	now        func() time.Time
+}
+
+func newValueStore() *valueStore {
+	return &valueStore{values: make(map[structures.NodeID]storedValue), now: time.Now}
+}
+
+// put stores value under key till ttl runs out. A new value is turned down if the store
+// is full of values or bytes even once expired values are purged. The value of a stored
+// key can always be overwritten by one of no more bytes.
+func (v *valueStore) put(key structures.NodeID, value []byte, ttl time.Duration) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// expired values are only purged when they take up room, and once one of them
+	// expired, so that puts don't walk the whole store
+	now := v.now()
+	if !v.fits(key, value) && !now.Before(v.nextExpiry) {
+		v.purge(now)
+	}
+	if !v.fits(key, value) {
+		return false
+	}
+
+	if s, ok := v.values[key]; ok {
+		v.bytes -= len(s.value)
+	}
+	expires := now.Add(ttl)
+	v.values[key] = storedValue{value: value, expires: expires}
+	v.bytes += len(value)
+	if v.nextExpiry.IsZero() || expires.Before(v.nextExpiry) {
+		v.nextExpiry = expires
+	}
+	return true
+}
+
+// fits reports whether value can be stored under key without going over the limits of the store
+func (v *valueStore) fits(key structures.NodeID, value []byte) bool {
+	count, bytes := len(v.values), v.bytes
+	if s, ok := v.values[key]; ok {
+		count--
+		bytes -= len(s.value)
+	}
+	return count < constants.MAX_STORED_VALUES && bytes+len(value) <= constants.MAX_STORED_BYTES
+}
+
+// purge deletes the values expired at now and finds the next one to expire
+func (v *valueStore) purge(now time.Time) {
+	v.nextExpiry = time.Time{}
+	for k, s := range v.values {
+		if now.After(s.expires) {
+			delete(v.values, k)
+			v.bytes -= len(s.value)
+		} else if v.nextExpiry.IsZero() || s.expires.Before(v.nextExpiry) {
+			v.nextExpiry = s.expires
+		}
+	}
+}
+
+// get returns the value of key if present and not expired
+func (v *valueStore) get(key structures.NodeID) ([]byte, bool) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	s, ok := v.values[key]
+	if !ok || v.now().After(s.expires) {
+		return nil, false
+	}
+	return s.value, true
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"hydra-dht/constants"
+	pb "hydra-dht/protobuf/node"
+	"hydra-dht/structures"
+	"math"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValueStore(t *testing.T) {
+	values := newValueStore()
+	now := time.Now()
+	values.now = func() time.Time { return now }
+
+	key := structures.NodeID{1}
+	values.put(key, []byte("first"), time.Minute)
+	if value, ok := values.get(key); !ok || string(value) != "first" {
+		t.Errorf("get => %q, %v;want the stored value", value, ok)
+	}
+	if _, ok := values.get(structures.NodeID{2}); ok {
+		t.Errorf("get of a key never stored => found")
+	}
+
+	// storing a key again overwrites its value and ttl
+	values.put(key, []byte("second"), 2*time.Minute)
+	now = now.Add(90 * time.Second)
+	if value, ok := values.get(key); !ok || string(value) != "second" {
+		t.Errorf("get after overwrite => %q, %v;want the new value", value, ok)
+	}
+
+	// expired values aren't found, and are only purged once they take up room
+	now = now.Add(time.Minute)
+	if _, ok := values.get(key); ok {
+		t.Errorf("get of an expired value => found")
+	}
+	values.put(structures.NodeID{2}, []byte("other"), time.Minute)
+	if len(values.values) != 2 {
+		t.Errorf("values after put => %d;want the expired value kept till the store is full", len(values.values))
+	}
+}
+
+func TestValueStoreFull(t *testing.T) {
+	values := newValueStore()
+	now := time.Now()
+	values.now = func() time.Time { return now }
+
+	// the first value expires before the others
+	for i := 0; i < constants.MAX_STORED_VALUES; i++ {
+		key := structures.NodeID{byte(i), byte(i >> 8)}
+		ttl := 2 * time.Minute
+		if i == 0 {
+			ttl = time.Minute
+		}
+		if !values.put(key, []byte("value"), ttl) {
+			t.Fatalf("put of value %d => turned down;want it stored", i)
+		}
+	}
+	if values.put(structures.NodeID{0xff, 0xff, 0xff}, []byte("value"), time.Minute) {
+		t.Errorf("put of a new key into a full store => stored;want it turned down")
+	}
+	if !values.put(structures.NodeID{1, 0}, []byte("overwrite"), 2*time.Minute) {
+		t.Errorf("put of a stored key into a full store => turned down;want it overwritten")
+	}
+
+	// the expired value is purged to make room
+	now = now.Add(90 * time.Second)
+	if !values.put(structures.NodeID{0xff, 0xff, 0xff}, []byte("value"), time.Minute) {
+		t.Errorf("put of a new key into a store with an expired value => turned down;want it stored")
+	}
+	if _, ok := values.values[structures.NodeID{0, 0}]; ok {
+		t.Errorf("put into a full store => the expired value was kept")
+	}
+	if values.put(structures.NodeID{0xfe, 0xff, 0xff}, []byte("value"), time.Minute) {
+		t.Errorf("put of a new key into a full store => stored;want it turned down")
+	}
+}
+
+func TestValueStoreBytes(t *testing.T) {
+	values := newValueStore()
+	now := time.Now()
+	values.now = func() time.Time { return now }
+
+	// the values share their bytes, the store counts them once per value
+	value := make([]byte, constants.MAX_VALUE_SIZE)
+	for i := 0; i < constants.MAX_STORED_BYTES/constants.MAX_VALUE_SIZE; i++ {
+		if !values.put(structures.NodeID{byte(i), byte(i >> 8)}, value, time.Minute) {
+			t.Fatalf("put of value %d => turned down;want it stored", i)
+		}
+	}
+	if values.put(structures.NodeID{0xff, 0xff, 0xff}, []byte("v"), time.Minute) {
+		t.Errorf("put of a new key into a store full of bytes => stored;want it turned down")
+	}
+	if values.put(structures.NodeID{0, 0}, append(value, 'v'), time.Minute) {
+		t.Errorf("put of a larger value into a store full of bytes => stored;want it turned down")
+	}
+
+	// a smaller value makes room
+	if !values.put(structures.NodeID{0, 0}, value[1:], time.Minute) {
+		t.Errorf("put of a smaller value into a store full of bytes => turned down;want it overwritten")
+	}
+	if !values.put(structures.NodeID{0xff, 0xff, 0xff}, []byte("v"), time.Minute) {
+		t.Errorf("put of a value into the freed bytes => turned down;want it stored")
+	}
+	if values.bytes != constants.MAX_STORED_BYTES {
+		t.Errorf("bytes of the store => %d;want %d", values.bytes, constants.MAX_STORED_BYTES)
+	}
+
+	// expired values give back their bytes
+	now = now.Add(2 * time.Minute)
+	if !values.put(structures.NodeID{0xfe, 0xff, 0xff}, value, time.Minute) || values.bytes != constants.MAX_VALUE_SIZE {
+		t.Errorf("put into a store of expired values => %d bytes stored;want only the new value's", values.bytes)
+	}
+}
+
+func TestStoreRequests(t *testing.T) {
+	s := &NodeServer{values: newValueStore()}
+	key := make([]byte, constants.NUM_BYTES)
+
+	var tests = []struct {
+		name    string
+		request *pb.StoreRequest
+		ok      bool
+	}{
+		{"valid", &pb.StoreRequest{Key: key, Value: []byte("v"), Ttl: 60}, true},
+		{"short key", &pb.StoreRequest{Key: key[:4], Value: []byte("v"), Ttl: 60}, false},
+		{"zero ttl", &pb.StoreRequest{Key: key, Value: []byte("v"), Ttl: 0}, false},
+		{"negative ttl", &pb.StoreRequest{Key: key, Value: []byte("v"), Ttl: -1}, false},
+		{"oversized value", &pb.StoreRequest{Key: key, Value: make([]byte, constants.MAX_VALUE_SIZE+1), Ttl: 60}, false},
+		{"largest value", &pb.StoreRequest{Key: key, Value: make([]byte, constants.MAX_VALUE_SIZE), Ttl: 60}, true},
+		{"ttl overflowing a duration", &pb.StoreRequest{Key: key, Value: []byte("v"), Ttl: math.MaxInt64}, true},
+	}
+	for _, test := range tests {
+		response, err := s.Store(context.Background(), test.request)
+		if test.ok && (err != nil || !response.Stored) {
+			t.Errorf("Store of %s request => %v | (ERROR)= %v;want it stored", test.name, response, err)
+		}
+		if !test.ok && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Store of %s request => %v;want an InvalidArgument error", test.name, err)
+		}
+	}
+
+	// the huge ttl is clamped to the longest one kept
+	if expires := s.values.values[structures.NodeID{}].expires; time.Until(expires) > constants.MAX_VALUE_TTL || time.Until(expires) < constants.MAX_VALUE_TTL-time.Minute {
+		t.Errorf("Store with a huge ttl => expires in %v;want %v", time.Until(expires), constants.MAX_VALUE_TTL)
+	}
+
+	if _, err := s.FindValue(context.Background(), &pb.FindValueRequest{Key: key[:4]}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("FindValue with a short key => %v;want an InvalidArgument error", err)
+	}
+	response, err := s.FindValue(context.Background(), &pb.FindValueRequest{Key: key})
+	if err != nil || !response.Found || string(response.Value) != "v" {
+		t.Errorf("FindValue => %v | (ERROR)= %v;want the stored value", response, err)
+	}
+}
@@ -1,7 +1,11 @@
 package structures
 
 import (
+	"encoding/hex"
+	"fmt"
 	constants "hydra-dht/constants"
+	"math/big"
+	"strings"
 	"time"
 )
 
@@ -16,9 +20,11 @@ type Node struct {
 }
 
 // NodePacket wraps Node and NodeResponse for data sending
+// RemoveResponse is set instead of NodeResponse for packets removing the node
 type NodePacket struct {
-	Node         Node
-	NodeResponse chan AddNodeResponse
+	Node           Node
+	NodeResponse   chan AddNodeResponse
+	RemoveResponse chan RemoveNodeResponse
 }
 
 // DHT is the main DHT data structure. It consists of a Map of all Nodes to check for duplicity.
@@ -32,9 +38,17 @@ type Cache struct {
 	Lists [constants.HASH_SIZE][]CacheObject
 }
 
+// Replacements keeps the recently seen candidates for each row of the DHT whose
+// bucket was full when they were seen, freshest last
+type Replacements struct {
+	Lists [constants.HASH_SIZE][]Node
+}
+
 // IndexChannels keeps track of all the channels for the 256 keys of DHT
+// SeenChannel queues the nodes of a row that responded to a request
 type IndexChannels struct {
 	WriteChannel [constants.HASH_SIZE]chan *NodePacket
+	SeenChannel  [constants.HASH_SIZE]chan Node
 }
 
 // CacheObject is the object stored in DHT cache.
@@ -48,9 +62,92 @@ type CacheObject struct {
 // AddNodeResponse is the response after AddNode function of DHT. It tells you if
 // the list index the node is inserted in
 // whether the ping action was required for it to be inserted i.e if the list was full
-// and lastly Input defines if the node was rejected or not
+// Input defines if the node was rejected or not
+// and lastly Replacement defines if a rejected node was kept as a replacement candidate
 type AddNodeResponse struct {
+	ListIndex   int
+	Ping        bool
+	Input       bool
+	Replacement bool
+}
+
+// RemoveNodeResponse is the response after RemoveNode function of DHT. It tells you
+// the list index the node was removed from, -1 if it wasn't in the DHT
+// and whether the node was removed or not
+type RemoveNodeResponse struct {
 	ListIndex int
-	Ping      bool
-	Input     bool
+	Removed   bool
+}
+
+// base58Alphabet is the bitcoin base58 alphabet used for printable node ids
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// Hex returns the hex encoding of the node id
+func (id NodeID) Hex() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Base58 returns the base58 encoding of the node id
+func (id NodeID) Base58() string {
+	zeros := 0
+	for zeros < len(id) && id[zeros] == 0 {
+		zeros++
+	}
+
+	n := new(big.Int).SetBytes(id[:])
+	radix := big.NewInt(int64(len(base58Alphabet)))
+	mod := new(big.Int)
+	var encoded []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		encoded = append(encoded, base58Alphabet[mod.Int64()])
+	}
+	for i := 0; i < zeros; i++ {
+		encoded = append(encoded, base58Alphabet[0])
+	}
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
+
+// ParseNodeIDHex parses a node id from its 64 character hex encoding
+func ParseNodeIDHex(s string) (NodeID, error) {
+	var id NodeID
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(decoded) != constants.NUM_BYTES {
+		return id, fmt.Errorf("node id %q is %d bytes, wanted %d", s, len(decoded), constants.NUM_BYTES)
+	}
+	copy(id[:], decoded)
+	return id, nil
+}
+
+// ParseNodeIDBase58 parses a node id from its base58 encoding
+func ParseNodeIDBase58(s string) (NodeID, error) {
+	var id NodeID
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+
+	n := new(big.Int)
+	radix := big.NewInt(int64(len(base58Alphabet)))
+	for i := 0; i < len(s); i++ {
+		digit := strings.IndexByte(base58Alphabet, s[i])
+		if digit < 0 {
+			return id, fmt.Errorf("node id %q has illegal base58 character %q", s, s[i])
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+
+	decoded := n.Bytes()
+	if zeros+len(decoded) != constants.NUM_BYTES {
+		return id, fmt.Errorf("node id %q is %d bytes, wanted %d", s, zeros+len(decoded), constants.NUM_BYTES)
+	}
+	copy(id[zeros:], decoded)
+	return id, nil
 }
@@ -0,0 +1,34 @@
+package structures_test
+
+import (
+	"hydra-dht/structures"
+	"testing"
+)
+
+func TestParseNodeID(t *testing.T) {
+
+	var tests = []structures.NodeID{
+		{5, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124},
+		{0, 0, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 124, 234, 4, 67, 0},
+		{},
+	}
+	for _, test := range tests {
+		id, err := structures.ParseNodeIDHex(test.Hex())
+		if err != nil || id != test {
+			t.Errorf("ParseNodeIDHex(%q) => %v, %v; want %v", test.Hex(), id, err, test)
+		}
+
+		id, err = structures.ParseNodeIDBase58(test.Base58())
+		if err != nil || id != test {
+			t.Errorf("ParseNodeIDBase58(%q) => %v, %v; want %v", test.Base58(), id, err, test)
+		}
+	}
+
+	// rubbish node ids
+	if _, err := structures.ParseNodeIDHex("a948904f"); err == nil {
+		t.Errorf("ParseNodeIDHex should error out on a short id, but err was nil")
+	}
+	if _, err := structures.ParseNodeIDBase58("0OIl"); err == nil {
+		t.Errorf("ParseNodeIDBase58 should error out on illegal characters, but err was nil")
+	}
+}